@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/password"
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/TokenPurpose"
+	"github.com/thedanisaur/jfl_platform/util"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// AccountLookup is implemented by the service that owns the users table.
+type AccountLookup interface {
+	UserLookup
+	ImpersonationLookup
+	MarkEmailVerified(txid uuid.UUID, user_id uuid.UUID, email string) error
+}
+
+// ActionTokenSender delivers password reset and email verification tokens,
+// usually by email with a link to the web UI. Password reset tokens are sent
+// by a few background workers, so it must be safe for concurrent use.
+type ActionTokenSender interface {
+	SendActionToken(txid uuid.UUID, user types.UserResponse, purpose string, token string) error
+}
+
+type AccountOptions struct {
+	// ActionTokenStore makes action tokens single use
+	ActionTokenStore security.ActionTokenStore
+	// AttemptStore is reset after a password reset so the user isn't left locked out
+	AttemptStore security.LoginAttemptStore
+	// RevocationStore revokes the user's access tokens after a password reset when set
+	RevocationStore security.RevocationStore
+	// RefreshTokenStore revokes the user's refresh tokens after a password reset when set
+	RefreshTokenStore security.RefreshTokenStore
+	// SessionRegistry ends the user's sessions after a password reset when set
+	SessionRegistry *security.SessionRegistry
+}
+
+// Password reset requests are answered before the email goes out, the queue
+// bounds how much work anonymous callers can pile up.
+const (
+	password_reset_workers    = 4
+	password_reset_queue_size = 64
+)
+
+type passwordResetJob struct {
+	txid     uuid.UUID
+	username string
+}
+
+func transactionID(c *fiber.Ctx) uuid.UUID {
+	txid, ok := c.Locals("transaction_id").(uuid.UUID)
+	if !ok {
+		txid = uuid.New()
+		c.Locals("transaction_id", txid)
+	}
+	return txid
+}
+
+// PasswordResetRequestHandler sends a reset token to the user. It answers 202
+// before looking the user up, so neither the status nor the response time
+// reveals which usernames exist. Failures are only logged and requests are
+// dropped while the send queue is full.
+func PasswordResetRequestHandler(config types.Config, key_ring *security.KeyRing, accounts AccountLookup, sender ActionTokenSender) fiber.Handler {
+	queue := make(chan passwordResetJob, password_reset_queue_size)
+	for i := 0; i < password_reset_workers; i++ {
+		go func() {
+			for job := range queue {
+				sendPasswordReset(job.txid, job.username, config, key_ring, accounts, sender)
+			}
+		}()
+	}
+	return func(c *fiber.Ctx) error {
+		txid := transactionID(c)
+		log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(PasswordResetRequestHandler))
+
+		var request types.PasswordResetRequest
+		err := c.BodyParser(&request)
+		if err != nil || request.Username == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "username is required")
+		}
+		// The body is reused by fiber once the handler returns
+		job := passwordResetJob{txid: txid, username: strings.Clone(request.Username)}
+		select {
+		case queue <- job:
+		default:
+			log.Printf("%s | password reset queue is full, dropping the request\n", txid.String())
+		}
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+}
+
+func sendPasswordReset(txid uuid.UUID, username string, config types.Config, key_ring *security.KeyRing, accounts AccountLookup, sender ActionTokenSender) {
+	user, err := accounts.GetUserByUsername(txid, username)
+	if errors.Is(err, ErrUserNotFound) {
+		log.Printf("%s | no user to reset the password of\n", txid.String())
+		return
+	}
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return
+	}
+	// Bound to the current hash, the token stops working once the password changes
+	token, err := security.GenerateActionToken(txid, user.ID, TokenPurpose.PasswordReset, user.PasswordHash, config, key_ring)
+	if err != nil {
+		log.Printf("%s | failed to generate token: %s\n", txid.String(), err.Error())
+		return
+	}
+	err = sender.SendActionToken(txid, user, TokenPurpose.PasswordReset, token)
+	if err != nil {
+		log.Printf("%s | failed to send token: %s\n", txid.String(), err.Error())
+	}
+}
+
+// PasswordResetHandler sets a new password with a reset token. Every existing
+// token and session of the user is revoked and any lockout is cleared.
+func PasswordResetHandler(config types.Config, key_ring *security.KeyRing, accounts AccountLookup, options AccountOptions) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		txid := transactionID(c)
+		log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(PasswordResetHandler))
+
+		var request types.PasswordResetConfirmation
+		err := c.BodyParser(&request)
+		if err != nil || request.Token == "" || request.Password == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "token and password are required")
+		}
+		action_claims, err := security.ParseActionToken(txid, request.Token, TokenPurpose.PasswordReset, config, key_ring)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid or expired token")
+		}
+		user, err := accounts.GetUserByID(txid, action_claims.UserID)
+		if errors.Is(err, ErrUserNotFound) {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid or expired token")
+		}
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to reset password")
+		}
+		// Check the policy before consuming so the user can try again
+		err = password.CheckPolicy(request.Password, config, user.Email, user.FirstName, user.LastName, user.CallSign)
+		if err != nil {
+			return err
+		}
+		err = security.ConsumeActionToken(txid, action_claims, user.PasswordHash, options.ActionTokenStore)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid or expired token")
+		}
+
+		password_hash, err := password.Hash(request.Password, config)
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to reset password")
+		}
+		err = accounts.UpdatePasswordHash(txid, user.ID, password_hash)
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to reset password")
+		}
+		revokeAfterPasswordReset(txid, user, options)
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// revokeAfterPasswordReset logs failures rather than failing the request, the
+// password has already been changed.
+func revokeAfterPasswordReset(txid uuid.UUID, user types.UserResponse, options AccountOptions) {
+	if options.RevocationStore != nil {
+		err := security.RevokeUserTokens(txid, user.ID, time.Now().UTC(), options.RevocationStore)
+		if err != nil {
+			log.Printf("%s | failed to revoke tokens: %s\n", txid.String(), err.Error())
+		}
+	}
+	if options.RefreshTokenStore != nil {
+		err := options.RefreshTokenStore.RevokeUser(user.ID)
+		if err != nil {
+			log.Printf("%s | failed to revoke refresh tokens: %s\n", txid.String(), err.Error())
+		}
+	}
+	if options.SessionRegistry != nil {
+		err := options.SessionRegistry.RevokeAll(txid, user.ID)
+		if err != nil {
+			log.Printf("%s | failed to revoke sessions: %s\n", txid.String(), err.Error())
+		}
+	}
+	resetLockout(txid, user.ID, options.AttemptStore)
+}
+
+// EmailVerificationRequestHandler sends a verification token for the current
+// email of the authenticated user, mount it behind AuthenticationMiddleware.
+func EmailVerificationRequestHandler(config types.Config, key_ring *security.KeyRing, accounts AccountLookup, sender ActionTokenSender) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		txid := transactionID(c)
+		log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(EmailVerificationRequestHandler))
+
+		user_claims, ok := c.Locals("user_claims").(types.UserClaims)
+		if !ok {
+			return fiber.NewError(fiber.StatusUnauthorized, "not authenticated")
+		}
+		user, err := accounts.GetUserByID(txid, user_claims.UserID)
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to request email verification")
+		}
+		// Bound to the email, changing it again invalidates the token
+		token, err := security.GenerateActionToken(txid, user.ID, TokenPurpose.EmailVerification, user.Email, config, key_ring)
+		if err != nil {
+			log.Printf("%s | failed to generate token: %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to request email verification")
+		}
+		err = sender.SendActionToken(txid, user, TokenPurpose.EmailVerification, token)
+		if err != nil {
+			log.Printf("%s | failed to send token: %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to request email verification")
+		}
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+}
+
+// EmailVerificationHandler marks the email of the token's user as verified.
+func EmailVerificationHandler(config types.Config, key_ring *security.KeyRing, accounts AccountLookup, options AccountOptions) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		txid := transactionID(c)
+		log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(EmailVerificationHandler))
+
+		var request types.EmailVerificationConfirmation
+		err := c.BodyParser(&request)
+		if err != nil || request.Token == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "token is required")
+		}
+		action_claims, err := security.ParseActionToken(txid, request.Token, TokenPurpose.EmailVerification, config, key_ring)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid or expired token")
+		}
+		user, err := accounts.GetUserByID(txid, action_claims.UserID)
+		if errors.Is(err, ErrUserNotFound) {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid or expired token")
+		}
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to verify email")
+		}
+		err = security.ConsumeActionToken(txid, action_claims, user.Email, options.ActionTokenStore)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid or expired token")
+		}
+		err = accounts.MarkEmailVerified(txid, user.ID, user.Email)
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to verify email")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/handler"
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/TokenPurpose"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func (users *testUsers) MarkEmailVerified(txid uuid.UUID, user_id uuid.UUID, email string) error {
+	return nil
+}
+
+// testSender hands the sent tokens to the test.
+type testSender struct {
+	tokens chan string
+}
+
+func (sender *testSender) SendActionToken(txid uuid.UUID, user types.UserResponse, purpose string, token string) error {
+	sender.tokens <- token
+	return nil
+}
+
+func TestPasswordResetClearsLoginLockout(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testPasswordConfig()
+	config.App.Lockout.MaxAttempts = 2
+	config.App.Lockout.DurationMs = 60000
+	users, user := newTestUsers(t, config)
+	attempt_store := security.NewMemoryLoginAttemptStore()
+	sender := &testSender{tokens: make(chan string, 1)}
+
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/login", LoginHandler(config, key_ring, users, LoginOptions{AttemptStore: attempt_store}))
+	app.Post("/reset/request", PasswordResetRequestHandler(config, key_ring, users, sender))
+	app.Post("/reset", PasswordResetHandler(config, key_ring, users, AccountOptions{
+		ActionTokenStore: security.NewMemoryActionTokenStore(),
+		AttemptStore:     attempt_store,
+	}))
+
+	// The username the user logs in with doesn't have to be their email
+	username := strings.ToUpper(user.Email)
+	users.users[username] = user
+	for i := 0; i < config.App.Lockout.MaxAttempts; i++ {
+		testSend(t, app, testLoginRequest(username, "wrong"))
+	}
+	status, _ := testSend(t, app, testLoginRequest(username, test_password))
+	if status != fiber.StatusTooManyRequests {
+		t.Fatalf("expected the account to be locked, got %d", status)
+	}
+
+	// Unknown users get the same answer and nothing is sent
+	request := httptest.NewRequest(fiber.MethodPost, "/reset/request", strings.NewReader(`{"username": "nobody@jfl.test"}`))
+	request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	status, _ = testSend(t, app, request)
+	if status != fiber.StatusAccepted {
+		t.Fatalf("expected 202 for an unknown user, got %d", status)
+	}
+	request = httptest.NewRequest(fiber.MethodPost, "/reset/request", strings.NewReader(`{"username": "`+user.Email+`"}`))
+	request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	status, _ = testSend(t, app, request)
+	if status != fiber.StatusAccepted {
+		t.Fatalf("expected 202, got %d", status)
+	}
+	var token string
+	select {
+	case token = <-sender.tokens:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reset token was never sent")
+	}
+	select {
+	case <-sender.tokens:
+		t.Fatal("only one token should have been sent")
+	default:
+	}
+
+	new_password := "a different horse battery staple"
+	request = httptest.NewRequest(fiber.MethodPost, "/reset", strings.NewReader(`{"token": "`+token+`", "password": "`+new_password+`"}`))
+	request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	status, body := testSend(t, app, request)
+	if status != fiber.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", status, body)
+	}
+
+	status, body = testSend(t, app, testLoginRequest(username, new_password))
+	if status != fiber.StatusOK {
+		t.Fatalf("the reset must clear the lockout, got %d: %s", status, body)
+	}
+}
+
+func TestPasswordResetEndsSessions(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testPasswordConfig()
+	users, user := newTestUsers(t, config)
+	registry, err := security.NewSessionRegistry(security.NewMemorySessionStore(), security.NewMemoryRevocationStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/login", LoginHandler(config, key_ring, users, LoginOptions{SessionRegistry: registry}))
+	app.Post("/reset", PasswordResetHandler(config, key_ring, users, AccountOptions{
+		ActionTokenStore: security.NewMemoryActionTokenStore(),
+		SessionRegistry:  registry,
+	}))
+
+	status, body := testSend(t, app, testLoginRequest(user.Email, test_password))
+	if status != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", status, body)
+	}
+	sessions, err := registry.List(uuid.New(), types.UserClaims{UserID: user.ID})
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("expected one session, got %d %v", len(sessions), err)
+	}
+
+	token, err := security.GenerateActionToken(uuid.New(), user.ID, TokenPurpose.PasswordReset, user.PasswordHash, config, key_ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(fiber.MethodPost, "/reset", strings.NewReader(`{"token": "`+token+`", "password": "a different horse battery staple"}`))
+	request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	status, body = testSend(t, app, request)
+	if status != fiber.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", status, body)
+	}
+	sessions, err = registry.List(uuid.New(), types.UserClaims{UserID: user.ID})
+	if err != nil || len(sessions) != 0 {
+		t.Fatalf("expected the reset to end every session, got %d %v", len(sessions), err)
+	}
+}
+
+func TestPasswordResetRequestsAreBounded(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testPasswordConfig()
+	users, user := newTestUsers(t, config)
+	// Unbuffered, every worker blocks on its first send until the test reads
+	sender := &testSender{tokens: make(chan string)}
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/reset/request", PasswordResetRequestHandler(config, key_ring, users, sender))
+
+	requests := password_reset_workers + password_reset_queue_size + 8
+	for i := 0; i < requests; i++ {
+		request := httptest.NewRequest(fiber.MethodPost, "/reset/request", strings.NewReader(`{"username": "`+user.Email+`"}`))
+		request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		status, _ := testSend(t, app, request)
+		// Dropped requests get the same answer
+		if status != fiber.StatusAccepted {
+			t.Fatalf("expected 202, got %d", status)
+		}
+	}
+
+	sent := 0
+	for draining := true; draining; {
+		select {
+		case <-sender.tokens:
+			sent++
+		case <-time.After(500 * time.Millisecond):
+			draining = false
+		}
+	}
+	if sent < password_reset_queue_size || sent > password_reset_workers+password_reset_queue_size {
+		t.Fatalf("expected between %d and %d tokens, %d were sent", password_reset_queue_size, password_reset_workers+password_reset_queue_size, sent)
+	}
+}
@@ -0,0 +1,24 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/thedanisaur/jfl_platform/types"
+)
+
+type AuditLogger interface {
+	Audit(event types.AuditEvent)
+}
+
+// LogAuditLogger writes audit events to the standard logger as json.
+type LogAuditLogger struct{}
+
+func (LogAuditLogger) Audit(event types.AuditEvent) {
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("%s | failed to marshal audit event: %s\n", event.TransactionID.String(), err.Error())
+		return
+	}
+	log.Printf("%s | audit | %s\n", event.TransactionID.String(), string(bytes))
+}
@@ -1,37 +1,228 @@
 package auth
 
 import (
-	"crypto/rsa"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/thedanisaur/jfl_platform/security"
 	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/MutualTLSMode"
 	"github.com/thedanisaur/jfl_platform/util"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
-func AuthenticationMiddleware(config types.Config, public_key *rsa.PublicKey) fiber.Handler {
+type AuthenticationOptions struct {
+	// RevocationStore is consulted for revoked tokens when set
+	RevocationStore security.RevocationStore
+	// AuditLogger records requests made while impersonating when set
+	AuditLogger AuditLogger
+	// ClientCAs verifies client certificates when Config.App.MutualTLS.Mode is set
+	ClientCAs *x509.CertPool
+	// APIKeyStore accepts the X-API-Key header in place of a bearer token when
+	// set, only in the MutualTLS modes where a bearer token alone is enough
+	APIKeyStore security.APIKeyStore
+	// CSRFTokenStore verifies synchronizer tokens when Config.App.Cookie.CSRFMode is synchronizer
+	CSRFTokenStore security.CSRFTokenStore
+	// ClaimsProvider refreshes role, units and qualifications from the database when set
+	ClaimsProvider ClaimsProvider
+	// UserStatus rejects tokens of users that aren't approved when set, wrap it
+	// in a CachedUserStatusLookup to avoid a query per request
+	UserStatus UserStatusLookup
+	// PublicRoutes skip authentication entirely, i.e. health checks and login
+	PublicRoutes []RouteRule
+	// OptionalRoutes populate user_claims when credentials are sent but let
+	// anonymous requests through
+	OptionalRoutes []RouteRule
+}
+
+// authenticate applies Config.App.MutualTLS.Mode to decide between the client
+// certificate and the bearer token. When accept_clients is set, machine client
+// tokens are accepted wherever a bearer token alone is enough and are returned
+// as client claims instead of user claims.
+func authenticate(txid uuid.UUID, c *fiber.Ctx, config types.Config, key_ring *security.KeyRing, options AuthenticationOptions, accept_clients bool) (types.UserClaims, *types.ClientClaims, error) {
+	validate_bearer := func() (types.UserClaims, *types.ClientClaims, error) {
+		if !accept_clients {
+			user_claims, err := security.ValidateJWT(txid, c, config, key_ring, options.RevocationStore)
+			return user_claims, nil, err
+		}
+		user_claims, client_claims, err := security.ValidateAnyJWT(txid, c, config, key_ring, options.RevocationStore)
+		if err != nil || client_claims != nil {
+			return types.UserClaims{}, client_claims, err
+		}
+		return *user_claims, nil, nil
+	}
+	// An API key stands in for the bearer token, modes that require a
+	// certificate don't accept it
+	validate_credentials := func() (types.UserClaims, *types.ClientClaims, error) {
+		api_key := c.Get(security.HeaderAPIKey)
+		if api_key == "" || options.APIKeyStore == nil {
+			return validate_bearer()
+		}
+		user_claims, err := security.ValidateAPIKey(txid, api_key, options.APIKeyStore)
+		return user_claims, nil, err
+	}
+	switch config.App.MutualTLS.Mode {
+	case MutualTLSMode.Disabled:
+		return validate_credentials()
+	case MutualTLSMode.Certificate:
+		user_claims, err := security.ValidateClientCertificate(txid, c, config, options.ClientCAs)
+		return user_claims, nil, err
+	case MutualTLSMode.CertificateOrJWT:
+		user_claims, err := security.ValidateClientCertificate(txid, c, config, options.ClientCAs)
+		if errors.Is(err, security.ErrNoClientCertificate) {
+			return validate_credentials()
+		}
+		return user_claims, nil, err
+	case MutualTLSMode.CertificateAndJWT:
+		certificate_claims, err := security.ValidateClientCertificate(txid, c, config, options.ClientCAs)
+		if err != nil {
+			return types.UserClaims{}, nil, err
+		}
+		// Only a user token can belong to whoever holds the certificate
+		user_claims, err := security.ValidateJWT(txid, c, config, key_ring, options.RevocationStore)
+		if err != nil {
+			return types.UserClaims{}, nil, err
+		}
+		if certificate_claims.UserID != user_claims.UserID {
+			log.Printf("%s | certificate does not match token user\n", txid.String())
+			return types.UserClaims{}, nil, security.ErrInvalidClientCertificate.Wrap(errors.New("certificate does not match token"))
+		}
+		user_claims.AuthenticationMethods = append(user_claims.AuthenticationMethods, certificate_claims.AuthenticationMethods...)
+		return user_claims, nil, nil
+	}
+	return types.UserClaims{}, nil, fmt.Errorf("unsupported mutual tls mode: %s", config.App.MutualTLS.Mode)
+}
+
+// checkCSRF only applies to requests authenticated by the session cookie,
+// bearer tokens and API keys aren't sent by the browser on its own.
+func checkCSRF(txid uuid.UUID, c *fiber.Ctx, user_claims types.UserClaims, config types.Config, options AuthenticationOptions) error {
+	if user_claims.APIKeyID != "" || security.SessionCookieToken(c, config) == "" {
+		return nil
+	}
+	return security.VerifyCSRFToken(txid, c, user_claims, config, options.CSRFTokenStore)
+}
+
+// AuthenticationMiddleware populates `user_claims` from the bearer token, the
+// session cookie, an API key or the client certificate. Its errors carry their
+// status under any error handler, use handler.ErrorHandler for the problem
+// details and WWW-Authenticate challenges.
+func AuthenticationMiddleware(config types.Config, key_ring *security.KeyRing, options AuthenticationOptions) fiber.Handler {
+	return authenticationMiddleware(util.GetFunctionName(AuthenticationMiddleware), config, key_ring, options, false)
+}
+
+// AuthenticationMiddlewareWithClients accepts user tokens as well as machine
+// client tokens. User tokens populate `user_claims` and client tokens populate
+// `client_claims`, use RequireScopes on routes clients may call. API keys and
+// client certificates are handled exactly like AuthenticationMiddleware does.
+func AuthenticationMiddlewareWithClients(config types.Config, key_ring *security.KeyRing, options AuthenticationOptions) fiber.Handler {
+	return authenticationMiddleware(util.GetFunctionName(AuthenticationMiddlewareWithClients), config, key_ring, options, true)
+}
+
+func authenticationMiddleware(name string, config types.Config, key_ring *security.KeyRing, options AuthenticationOptions, accept_clients bool) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		txid := uuid.New()
-		log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(AuthenticationMiddleware))
+		log.Printf("%s | %s\n", txid.String(), name)
 
 		route := c.Route()
 		if route != nil {
 			log.Printf("%s | method: %s | path: %s | name: %s", txid.String(), route.Method, route.Path, route.Name)
 		}
+		// Set before anything can fail so handler.ErrorHandler reports it
+		c.Locals("transaction_id", txid)
+		if skipAuthentication(txid, c, config, options) {
+			return c.Next()
+		}
 
-		user_claims, err := security.ValidateJWT(txid, c, config, public_key)
+		user_claims, client_claims, err := authenticate(txid, c, config, key_ring, options, accept_clients)
 		if err != nil {
-			log.Printf("%s | Failed to Validate JWT\n", txid.String())
-			err_string := fmt.Sprintf("Unauthorized: %s\n", txid.String())
-			return c.Status(fiber.StatusInternalServerError).SendString(err_string)
+			log.Printf("%s | Failed to Validate JWT: %s\n", txid.String(), err.Error())
+			return err
+		}
+		if client_claims != nil {
+			log.Printf("Client claims: %v", *client_claims)
+			c.Locals("client_claims", *client_claims)
+			return c.Next()
 		}
 		log.Printf("User claims: %v", user_claims)
+		user_claims, err = checkUser(txid, c, user_claims, config, options)
+		if err != nil {
+			return err
+		}
 		c.Locals("user_claims", user_claims)
-		c.Locals("transaction_id", txid)
 		return c.Next()
 	}
 }
+
+// checkUser runs every check an authenticated user has to pass and refreshes
+// their claims.
+func checkUser(txid uuid.UUID, c *fiber.Ctx, user_claims types.UserClaims, config types.Config, options AuthenticationOptions) (types.UserClaims, error) {
+	err := checkCSRF(txid, c, user_claims, config, options)
+	if err != nil {
+		return types.UserClaims{}, err
+	}
+	err = checkImpersonation(txid, c, user_claims, options.AuditLogger)
+	if err != nil {
+		return types.UserClaims{}, err
+	}
+	err = checkUserStatus(txid, user_claims.UserID, options.UserStatus)
+	if err != nil {
+		return types.UserClaims{}, err
+	}
+	// An admin who is suspended loses the users they were impersonating as well
+	if user_claims.Actor != nil {
+		err = checkUserStatus(txid, user_claims.Actor.UserID, options.UserStatus)
+		if err != nil {
+			return types.UserClaims{}, err
+		}
+	}
+	return enrichClaims(txid, user_claims, options.ClaimsProvider)
+}
+
+// RequireScopes rejects client tokens and API keys that weren't granted every
+// scope. User tokens aren't scope limited, what a user may do is decided by
+// their policies.
+func RequireScopes(scopes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if user_claims, ok := c.Locals("user_claims").(types.UserClaims); ok {
+			if user_claims.APIKeyID == "" || security.HasScopes(user_claims.Scopes, scopes) {
+				return c.Next()
+			}
+			txid, _ := c.Locals("transaction_id").(uuid.UUID)
+			log.Printf("%s | api key %s missing scopes %v\n", txid.String(), user_claims.APIKeyID, scopes)
+			return insufficientScope(c, scopes)
+		}
+		client_claims, ok := c.Locals("client_claims").(types.ClientClaims)
+		if !ok || !security.HasScopes(client_claims.Scopes, scopes) {
+			txid, _ := c.Locals("transaction_id").(uuid.UUID)
+			log.Printf("%s | client %s missing scopes %v\n", txid.String(), client_claims.ClientID, scopes)
+			return insufficientScope(c, scopes)
+		}
+		return c.Next()
+	}
+}
+
+// RequireClientScopes only lets machine clients through that were granted
+// every scope, user tokens and API keys are rejected whatever they hold. Use it
+// for endpoints that serve other services, i.e. token introspection.
+func RequireClientScopes(scopes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		client_claims, ok := c.Locals("client_claims").(types.ClientClaims)
+		if !ok || !security.HasScopes(client_claims.Scopes, scopes) {
+			txid, _ := c.Locals("transaction_id").(uuid.UUID)
+			log.Printf("%s | client %s missing scopes %v\n", txid.String(), client_claims.ClientID, scopes)
+			return insufficientScope(c, scopes)
+		}
+		return c.Next()
+	}
+}
+
+// insufficientScope challenges with the scopes the route requires, RFC 6750.
+func insufficientScope(c *fiber.Ctx, scopes []string) error {
+	c.Set(fiber.HeaderWWWAuthenticate, fmt.Sprintf(`Bearer error="%s", scope="%s"`, security.ErrInsufficientScope.Code, strings.Join(scopes, " ")))
+	return security.ErrInsufficientScope
+}
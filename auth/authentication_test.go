@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/thedanisaur/jfl_platform/handler"
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/MutualTLSMode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func testKeyRing(t *testing.T) *security.KeyRing {
+	t.Helper()
+	private_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_ring := security.NewKeyRing()
+	err = key_ring.AddSigningKey("test", "", private_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key_ring
+}
+
+func testConfig() types.Config {
+	config := types.Config{}
+	config.App.Host.Issuer = "https://jfl.test"
+	config.App.LoginExpirationMs = 60000
+	config.App.RefreshExpirationMs = 3600000
+	return config
+}
+
+func testUserClaims() types.UserClaims {
+	return types.UserClaims{
+		UserID:      uuid.New(),
+		IssuingUnit: "unit",
+		RoleName:    "role",
+	}
+}
+
+func testUserToken(t *testing.T, user_claims types.UserClaims, config types.Config, key_ring *security.KeyRing) string {
+	t.Helper()
+	token, err := security.GenerateJWT(uuid.New(), user_claims, config, key_ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testApp mounts the middleware in front of a handler that reports who the
+// request was authenticated as.
+func testApp(middleware ...fiber.Handler) *fiber.App {
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	handlers := append(middleware, func(c *fiber.Ctx) error {
+		if user_claims, ok := c.Locals("user_claims").(types.UserClaims); ok {
+			return c.SendString("user " + user_claims.UserID.String())
+		}
+		if client_claims, ok := c.Locals("client_claims").(types.ClientClaims); ok {
+			return c.SendString("client " + client_claims.ClientID)
+		}
+		return c.SendString("anonymous")
+	})
+	app.All("/*", handlers...)
+	return app
+}
+
+func testSend(t *testing.T, app *fiber.App, request *http.Request) (int, string) {
+	t.Helper()
+	response, err := app.Test(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, string(body)
+}
+
+func TestAuthenticationMiddlewareWithClients(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	api_key_store := security.NewMemoryAPIKeyStore()
+	user_claims := testUserClaims()
+	api_key, _, err := security.GenerateAPIKey(uuid.New(), "integration", user_claims, nil, nil, nil, api_key_store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_token, err := security.GenerateClientJWT(uuid.New(), types.ClientClaims{ClientID: "scheduler", Scopes: []string{"read"}}, config, key_ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := AuthenticationOptions{
+		APIKeyStore:    api_key_store,
+		OptionalRoutes: []RouteRule{{Path: "/optional"}},
+	}
+	app := testApp(AuthenticationMiddlewareWithClients(config, key_ring, options))
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		value  string
+		status int
+		body   string
+	}{
+		{"user token", "/", fiber.HeaderAuthorization, "Bearer " + testUserToken(t, user_claims, config, key_ring), fiber.StatusOK, "user " + user_claims.UserID.String()},
+		{"client token", "/", fiber.HeaderAuthorization, "Bearer " + client_token, fiber.StatusOK, "client scheduler"},
+		{"api key", "/", security.HeaderAPIKey, api_key, fiber.StatusOK, "user " + user_claims.UserID.String()},
+		{"api key on optional route", "/optional", security.HeaderAPIKey, api_key, fiber.StatusOK, "user " + user_claims.UserID.String()},
+		{"anonymous on optional route", "/optional", "", "", fiber.StatusOK, "anonymous"},
+		{"anonymous", "/", "", "", fiber.StatusUnauthorized, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(fiber.MethodGet, test.path, nil)
+			if test.header != "" {
+				request.Header.Set(test.header, test.value)
+			}
+			status, body := testSend(t, app, request)
+			if status != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, status, body)
+			}
+			if test.body != "" && body != test.body {
+				t.Fatalf("expected %q, got %q", test.body, body)
+			}
+		})
+	}
+}
+
+func TestAPIKeyFollowsMutualTLSMode(t *testing.T) {
+	key_ring := testKeyRing(t)
+	api_key_store := security.NewMemoryAPIKeyStore()
+	user_claims := testUserClaims()
+	api_key, _, err := security.GenerateAPIKey(uuid.New(), "integration", user_claims, nil, nil, nil, api_key_store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := AuthenticationOptions{APIKeyStore: api_key_store}
+
+	// No client certificate is sent, an API key only helps where a certificate
+	// isn't required
+	tests := []struct {
+		mode   string
+		status int
+	}{
+		{MutualTLSMode.Disabled, fiber.StatusOK},
+		{MutualTLSMode.CertificateOrJWT, fiber.StatusOK},
+		{MutualTLSMode.Certificate, fiber.StatusUnauthorized},
+		{MutualTLSMode.CertificateAndJWT, fiber.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			config := testConfig()
+			config.App.MutualTLS.Mode = test.mode
+			app := testApp(AuthenticationMiddleware(config, key_ring, options))
+			request := httptest.NewRequest(fiber.MethodGet, "/", nil)
+			request.Header.Set(security.HeaderAPIKey, api_key)
+			status, body := testSend(t, app, request)
+			if status != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, status, body)
+			}
+			if status == fiber.StatusOK && body != "user "+user_claims.UserID.String() {
+				t.Fatalf("unexpected body %q", body)
+			}
+		})
+	}
+}
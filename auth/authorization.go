@@ -6,7 +6,9 @@ import (
 	"log"
 	"strings"
 
+	"github.com/thedanisaur/jfl_platform/security"
 	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
 	"github.com/thedanisaur/jfl_platform/util"
 
 	"github.com/google/cel-go/cel"
@@ -14,6 +16,8 @@ import (
 	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
 )
 
+var ErrNotAuthorized = types.NewPlatformError(ErrorKind.Forbidden, "not_authorized", "not authorized")
+
 func compileCelToSQL(expr string, scope map[string]string, request_user types.UserClaims) (string, []interface{}, error) {
 	// Parse CEL expression into AST
 	// TODO [drd] pull this out of here as the env will need to be built in each app
@@ -157,9 +161,34 @@ func compileExpression(expression *exprpb.Expr, scope map[string]string, request
 			return "", nil, fmt.Errorf("unsupported operator: %s", expression_kind.CallExpr.Function)
 		}
 
-		// Support `in`/`not in` with the requesting identifier(s) on the left side
-		// i.e.: request.unit_ids in record.unit_ids
+		// Boolean literals compile to conditions, compare against values instead
+		// i.e.: request_user.is_instructor == true
+		if sql_operation != "AND" && sql_operation != "OR" {
+			left_sql = booleanOperand(left_sql)
+			right_sql = booleanOperand(right_sql)
+		}
+
 		if sql_operation == "IN" || sql_operation == "NOT IN" {
+			// Support `in`/`not in` with a list of the requesting user on the right side
+			// i.e.: log.unit_charged in request_user.unit_ids
+			if isRequestUserList(expression_kind.CallExpr.Args[1], request_user) {
+				// Nothing is in an empty list
+				if len(right_args) == 0 {
+					if sql_operation == "IN" {
+						return "1=0", nil, nil
+					}
+					return "1=1", nil, nil
+				}
+				placeholders := make([]string, len(right_args))
+				for i := range placeholders {
+					placeholders[i] = "?"
+				}
+				sql := fmt.Sprintf("(%s %s (%s))", left_sql, sql_operation, strings.Join(placeholders, ", "))
+				return sql, append(left_args, right_args...), nil
+			}
+
+			// Support `in`/`not in` with the requesting identifier(s) on the left side
+			// i.e.: request.unit_ids in record.unit_ids
 			// left_args must be a slice (even if there's only one value)
 			if len(left_args) == 0 {
 				return "", nil, errors.New("left side of `in`/`not in` must be a list")
@@ -228,13 +257,64 @@ func compileExpression(expression *exprpb.Expr, scope map[string]string, request
 	return "", nil, errors.New("unsupported expression type")
 }
 
+func booleanOperand(sql string) string {
+	switch sql {
+	case "1=1":
+		return "TRUE"
+	case "1=0":
+		return "FALSE"
+	}
+	return sql
+}
+
+// isRequestUserList reports whether the expression is a list valued
+// request_user field, i.e. request_user.unit_ids
+func isRequestUserList(expression *exprpb.Expr, request_user types.UserClaims) bool {
+	select_expression, ok := expression.ExprKind.(*exprpb.Expr_SelectExpr)
+	if !ok {
+		return false
+	}
+	ident, ok := select_expression.SelectExpr.Operand.ExprKind.(*exprpb.Expr_IdentExpr)
+	if !ok || ident.IdentExpr.Name != "request_user" {
+		return false
+	}
+	accessor, ok := types.UserClaimsAccessors[select_expression.SelectExpr.Field]
+	if !ok {
+		return false
+	}
+	_, ok = accessor(&request_user).([]interface{})
+	return ok
+}
+
+// checkRequestUser applies the restrictions that come with the credentials
+// rather than the policies, they are the same for reads and writes except that
+// impersonation tokens are read only unless the admin asked for write access.
+func checkRequestUser(txid uuid.UUID, resource string, operation string, request_user types.UserClaims, write bool) error {
+	if request_user.Actor != nil {
+		log.Printf("%s | %s acting as %s | resource: %s | operation: %s\n", txid.String(), request_user.Actor.UserID.String(), request_user.UserID.String(), resource, operation)
+		if write && !request_user.Actor.AllowWrite {
+			return ErrImpersonationReadOnly
+		}
+	}
+	// API keys may be restricted to a subset of resources
+	if !security.AllowsResource(request_user.Resources, resource) {
+		log.Printf("%s | api key %s not allowed on resource: %s\n", txid.String(), request_user.APIKeyID, resource)
+		return ErrNotAuthorized
+	}
+	return nil
+}
+
 func EvaluateRead(txid uuid.UUID, resource string, operation string, scope map[string]string, request_user types.UserClaims, policies []types.PermissionDTO) (string, []interface{}, error) {
 	log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(EvaluateRead))
+	err := checkRequestUser(txid, resource, operation, request_user, false)
+	if err != nil {
+		return "", nil, err
+	}
 
 	for _, policy := range policies {
 		// Implicit deny overrides any allow
 		if policy.Effect != "allow" {
-			return "", nil, errors.New("not authorized")
+			return "", nil, ErrNotAuthorized
 		}
 	}
 
@@ -263,8 +343,14 @@ func EvaluateRead(txid uuid.UUID, resource string, operation string, scope map[s
 	return filter_string, args, nil
 }
 
-func EvaluateWrite(txid uuid.UUID, resource string, operation string, record map[string]interface{}, request_user map[string]interface{}, policies []types.PermissionDTO) (bool, error) {
-	log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(EvaluateRead))
+// EvaluateWrite reports whether the policies allow request_user to write the
+// record. In the policies request_user is types.UserClaimsMap of the claims.
+func EvaluateWrite(txid uuid.UUID, resource string, operation string, record map[string]interface{}, request_user types.UserClaims, policies []types.PermissionDTO) (bool, error) {
+	log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(EvaluateWrite))
+	err := checkRequestUser(txid, resource, operation, request_user, true)
+	if err != nil {
+		return false, err
+	}
 
 	env, err := cel.NewEnv(
 		cel.Variable("record", cel.MapType(cel.StringType, cel.DynType)),
@@ -276,7 +362,7 @@ func EvaluateWrite(txid uuid.UUID, resource string, operation string, record map
 
 	vars := map[string]interface{}{
 		"record":       record,
-		"request_user": request_user,
+		"request_user": types.UserClaimsMap(request_user),
 	}
 
 	allowed := false
@@ -299,13 +385,13 @@ func EvaluateWrite(txid uuid.UUID, resource string, operation string, record map
 		ok, is_boolean := result.Value().(bool)
 		if !is_boolean {
 			// TODO [drd] log that this is an invalid policy
-			return false, fmt.Errorf("not authorized")
+			return false, ErrNotAuthorized
 		}
 		// Deny any policies that the effect is not `allow`
 		if policy.Effect == "allow" && ok {
 			allowed = true
 		} else {
-			return false, errors.New("not authorized")
+			return false, ErrNotAuthorized
 		}
 	}
 	return allowed, nil
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/thedanisaur/jfl_platform/types"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func testPolicy(expression string) types.PermissionDTO {
+	return types.PermissionDTO{
+		ID:                  uuid.New(),
+		Resource:            "logs",
+		Operation:           "update",
+		Effect:              "allow",
+		ConditionType:       "cel",
+		ConditionExpression: expression,
+	}
+}
+
+func TestEvaluateReadCompilesRequestUserList(t *testing.T) {
+	scope := map[string]string{"log": "flight_logs"}
+	policies := []types.PermissionDTO{testPolicy("log.unit_id in request_user.unit_ids")}
+	user_claims := testUserClaims()
+
+	user_claims.UnitIDs = []string{"a", "b"}
+	filter, args, err := EvaluateRead(uuid.New(), "logs", "read", scope, user_claims, policies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter != "(flight_logs.unit_id IN (?, ?))" {
+		t.Fatalf("unexpected filter %q", filter)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"a", "b"}) {
+		t.Fatalf("unexpected args %v", args)
+	}
+
+	// Nothing is in an empty list
+	user_claims.UnitIDs = nil
+	filter, args, err = EvaluateRead(uuid.New(), "logs", "read", scope, user_claims, policies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter != "1=0" || len(args) != 0 {
+		t.Fatalf("empty list should deny, got %q %v", filter, args)
+	}
+}
+
+func TestEvaluateReadComparesBooleans(t *testing.T) {
+	policies := []types.PermissionDTO{testPolicy("request_user.is_instructor == true")}
+	user_claims := testUserClaims()
+	user_claims.IsInstructor = true
+	filter, args, err := EvaluateRead(uuid.New(), "logs", "read", nil, user_claims, policies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter != "(? = TRUE)" || !reflect.DeepEqual(args, []interface{}{true}) {
+		t.Fatalf("unexpected filter %q %v", filter, args)
+	}
+}
+
+func TestEvaluateWriteImpersonation(t *testing.T) {
+	policies := []types.PermissionDTO{testPolicy("record.unit_id == request_user.issuing_unit")}
+	record := map[string]interface{}{"unit_id": "unit"}
+	user_claims := testUserClaims()
+	user_claims.Actor = &types.ActorClaims{UserID: uuid.New(), RoleName: "admin"}
+
+	_, err := EvaluateWrite(uuid.New(), "logs", "update", record, user_claims, policies)
+	if !errors.Is(err, ErrImpersonationReadOnly) {
+		t.Fatalf("expected read only impersonation, got %v", err)
+	}
+
+	user_claims.Actor.AllowWrite = true
+	allowed, err := EvaluateWrite(uuid.New(), "logs", "update", record, user_claims, policies)
+	if err != nil || !allowed {
+		t.Fatalf("write access should allow the write, got %v %v", allowed, err)
+	}
+
+	// Reads are never blocked by impersonation
+	user_claims.Actor.AllowWrite = false
+	_, _, err = EvaluateRead(uuid.New(), "logs", "read", nil, user_claims, []types.PermissionDTO{testPolicy("true")})
+	if err != nil {
+		t.Fatalf("read while impersonating failed: %v", err)
+	}
+}
+
+func TestEvaluateResourceRestriction(t *testing.T) {
+	policies := []types.PermissionDTO{testPolicy("true")}
+	user_claims := testUserClaims()
+	user_claims.APIKeyID = "key"
+	user_claims.Resources = []string{"aircrew"}
+
+	_, _, err := EvaluateRead(uuid.New(), "logs", "read", nil, user_claims, policies)
+	if !errors.Is(err, ErrNotAuthorized) {
+		t.Fatalf("read outside the key's resources: expected not authorized, got %v", err)
+	}
+	_, err = EvaluateWrite(uuid.New(), "logs", "update", map[string]interface{}{}, user_claims, policies)
+	if !errors.Is(err, ErrNotAuthorized) {
+		t.Fatalf("write outside the key's resources: expected not authorized, got %v", err)
+	}
+
+	user_claims.Resources = []string{"logs"}
+	_, _, err = EvaluateRead(uuid.New(), "logs", "read", nil, user_claims, policies)
+	if err != nil {
+		t.Fatalf("read inside the key's resources failed: %v", err)
+	}
+	allowed, err := EvaluateWrite(uuid.New(), "logs", "update", map[string]interface{}{}, user_claims, policies)
+	if err != nil || !allowed {
+		t.Fatalf("write inside the key's resources failed: %v %v", allowed, err)
+	}
+}
+
+func TestEvaluateWriteDeny(t *testing.T) {
+	record := map[string]interface{}{"unit_id": "other"}
+	policies := []types.PermissionDTO{testPolicy("record.unit_id == request_user.issuing_unit")}
+	_, err := EvaluateWrite(uuid.New(), "logs", "update", record, testUserClaims(), policies)
+	if !errors.Is(err, ErrNotAuthorized) {
+		t.Fatalf("expected not authorized, got %v", err)
+	}
+}
+
+func TestImpersonationBlocksUnsafeMethods(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	app := testApp(AuthenticationMiddleware(config, key_ring, AuthenticationOptions{}))
+
+	user_claims := testUserClaims()
+	user_claims.Actor = &types.ActorClaims{UserID: uuid.New(), RoleName: "admin"}
+	read_only := testUserToken(t, user_claims, config, key_ring)
+	user_claims.Actor.AllowWrite = true
+	read_write := testUserToken(t, user_claims, config, key_ring)
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		status int
+	}{
+		{"read only get", fiber.MethodGet, read_only, fiber.StatusOK},
+		{"read only post", fiber.MethodPost, read_only, fiber.StatusForbidden},
+		{"read write post", fiber.MethodPost, read_write, fiber.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, "/", nil)
+			request.Header.Set(fiber.HeaderAuthorization, "Bearer "+test.token)
+			status, body := testSend(t, app, request)
+			if status != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, status, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+
+	"github.com/google/uuid"
+)
+
+// ClaimsProvider loads the current attributes of a user so authorization
+// doesn't depend on what was true when the token was issued.
+type ClaimsProvider interface {
+	// GetUserAttributes returns ErrUserNotFound when the user no longer exists
+	GetUserAttributes(txid uuid.UUID, user_id uuid.UUID) (types.UserAttributes, error)
+}
+
+// ttlCache holds values by user id for a fixed time.
+type ttlCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[uuid.UUID]ttlCacheEntry
+}
+
+type ttlCacheEntry struct {
+	value      interface{}
+	expires_at time.Time
+}
+
+func newTTLCache(ttl time.Duration) *ttlCache {
+	return &ttlCache{
+		ttl:     ttl,
+		entries: map[uuid.UUID]ttlCacheEntry{},
+	}
+}
+
+func (cache *ttlCache) get(user_id uuid.UUID) (interface{}, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, ok := cache.entries[user_id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires_at) {
+		delete(cache.entries, user_id)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (cache *ttlCache) set(user_id uuid.UUID, value interface{}) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries[user_id] = ttlCacheEntry{value: value, expires_at: time.Now().Add(cache.ttl)}
+}
+
+func (cache *ttlCache) invalidate(user_id uuid.UUID) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.entries, user_id)
+}
+
+func (cache *ttlCache) invalidateAll() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries = map[uuid.UUID]ttlCacheEntry{}
+}
+
+// CachedClaimsProvider caches another ClaimsProvider by user id. Call
+// Invalidate when a user's role, units or qualifications change so the next
+// request sees them instead of waiting out the ttl.
+type CachedClaimsProvider struct {
+	provider ClaimsProvider
+	cache    *ttlCache
+}
+
+func NewCachedClaimsProvider(provider ClaimsProvider, ttl time.Duration) *CachedClaimsProvider {
+	return &CachedClaimsProvider{
+		provider: provider,
+		cache:    newTTLCache(ttl),
+	}
+}
+
+func (cached_provider *CachedClaimsProvider) GetUserAttributes(txid uuid.UUID, user_id uuid.UUID) (types.UserAttributes, error) {
+	if value, ok := cached_provider.cache.get(user_id); ok {
+		return value.(types.UserAttributes), nil
+	}
+	user_attributes, err := cached_provider.provider.GetUserAttributes(txid, user_id)
+	if err != nil {
+		return user_attributes, err
+	}
+	cached_provider.cache.set(user_id, user_attributes)
+	return user_attributes, nil
+}
+
+func (cached_provider *CachedClaimsProvider) Invalidate(user_id uuid.UUID) {
+	cached_provider.cache.invalidate(user_id)
+}
+
+func (cached_provider *CachedClaimsProvider) InvalidateAll() {
+	cached_provider.cache.invalidateAll()
+}
+
+// enrichClaims replaces the attributes of the claims with the provider's.
+// Claims are returned unchanged when there is no provider.
+func enrichClaims(txid uuid.UUID, user_claims types.UserClaims, provider ClaimsProvider) (types.UserClaims, error) {
+	if provider == nil {
+		return user_claims, nil
+	}
+	user_attributes, err := provider.GetUserAttributes(txid, user_claims.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		log.Printf("%s | user %s no longer exists\n", txid.String(), user_claims.UserID.String())
+		return types.UserClaims{}, security.ErrInvalidToken.Wrap(err)
+	}
+	if err != nil {
+		log.Printf("%s | failed to load user attributes: %s\n", txid.String(), err.Error())
+		return types.UserClaims{}, err
+	}
+	return user_attributes.Apply(user_claims), nil
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/handler"
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// testClaimsProvider counts its loads, users that aren't listed don't exist.
+type testClaimsProvider struct {
+	attributes map[uuid.UUID]types.UserAttributes
+	err        error
+	loads      int
+}
+
+func (provider *testClaimsProvider) GetUserAttributes(txid uuid.UUID, user_id uuid.UUID) (types.UserAttributes, error) {
+	provider.loads++
+	if provider.err != nil {
+		return types.UserAttributes{}, provider.err
+	}
+	user_attributes, ok := provider.attributes[user_id]
+	if !ok {
+		return types.UserAttributes{}, ErrUserNotFound
+	}
+	return user_attributes, nil
+}
+
+func TestCachedClaimsProvider(t *testing.T) {
+	user_id := uuid.New()
+	provider := &testClaimsProvider{attributes: map[uuid.UUID]types.UserAttributes{user_id: {RoleName: "pilot"}}}
+	cached_provider := NewCachedClaimsProvider(provider, 50*time.Millisecond)
+
+	get := func() string {
+		t.Helper()
+		user_attributes, err := cached_provider.GetUserAttributes(uuid.New(), user_id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user_attributes.RoleName
+	}
+	if role_name := get(); role_name != "pilot" || provider.loads != 1 {
+		t.Fatalf("expected pilot from one load, got %s from %d", role_name, provider.loads)
+	}
+
+	// Within the ttl a change isn't seen until the user is invalidated
+	provider.attributes[user_id] = types.UserAttributes{RoleName: "instructor"}
+	if role_name := get(); role_name != "pilot" || provider.loads != 1 {
+		t.Fatalf("expected the cached pilot, got %s from %d loads", role_name, provider.loads)
+	}
+	cached_provider.Invalidate(user_id)
+	if role_name := get(); role_name != "instructor" || provider.loads != 2 {
+		t.Fatalf("expected instructor after invalidating, got %s from %d loads", role_name, provider.loads)
+	}
+
+	// After the ttl the provider is asked again
+	provider.attributes[user_id] = types.UserAttributes{RoleName: "evaluator"}
+	time.Sleep(60 * time.Millisecond)
+	if role_name := get(); role_name != "evaluator" || provider.loads != 3 {
+		t.Fatalf("expected evaluator after the ttl, got %s from %d loads", role_name, provider.loads)
+	}
+
+	// Failures aren't cached
+	_, err := cached_provider.GetUserAttributes(uuid.New(), uuid.New())
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	cached_provider.GetUserAttributes(uuid.New(), uuid.New())
+	if provider.loads != 5 {
+		t.Fatalf("expected every missing user to be loaded, got %d loads", provider.loads)
+	}
+}
+
+func TestAuthenticationEnrichesUserClaims(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	user_claims := testUserClaims()
+	user_claims.UnitIDs = []string{"unit"}
+	user_claims.MDSQualifications = []string{"C-17"}
+	user_attributes := types.UserAttributes{
+		IssuingUnit:       "other unit",
+		RoleName:          "instructor",
+		UnitIDs:           []string{"other unit", "third unit"},
+		IsInstructor:      true,
+		MDSQualifications: []string{"C-130"},
+	}
+	token := "Bearer " + testUserToken(t, user_claims, config, key_ring)
+	unknown_token := "Bearer " + testUserToken(t, testUserClaims(), config, key_ring)
+
+	tests := []struct {
+		name   string
+		token  string
+		err    error
+		status int
+	}{
+		{"enriched", token, nil, fiber.StatusOK},
+		{"user no longer exists", unknown_token, nil, fiber.StatusUnauthorized},
+		{"provider failure", token, errors.New("database is down"), fiber.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &testClaimsProvider{
+				attributes: map[uuid.UUID]types.UserAttributes{user_claims.UserID: user_attributes},
+				err:        test.err,
+			}
+			app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+			app.Get("/", AuthenticationMiddleware(config, key_ring, AuthenticationOptions{ClaimsProvider: provider}), func(c *fiber.Ctx) error {
+				return c.JSON(c.Locals("user_claims"))
+			})
+			request := httptest.NewRequest(fiber.MethodGet, "/", nil)
+			request.Header.Set(fiber.HeaderAuthorization, test.token)
+			response, err := app.Test(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			if response.StatusCode != test.status {
+				t.Fatalf("expected %d, got %d", test.status, response.StatusCode)
+			}
+			if test.status == fiber.StatusUnauthorized {
+				challenge := response.Header.Get(fiber.HeaderWWWAuthenticate)
+				if challenge != `Bearer error="invalid_token", error_description="`+security.ErrInvalidToken.Message+`"` {
+					t.Fatalf("expected an invalid_token challenge, got %q", challenge)
+				}
+			}
+			if test.status != fiber.StatusOK {
+				return
+			}
+
+			var enriched_claims types.UserClaims
+			err = json.NewDecoder(response.Body).Decode(&enriched_claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if enriched_claims.UserID != user_claims.UserID {
+				t.Fatalf("expected the identity to be kept, got %s", enriched_claims.UserID)
+			}
+			if enriched_claims.IssuingUnit != user_attributes.IssuingUnit ||
+				enriched_claims.RoleName != user_attributes.RoleName ||
+				!reflect.DeepEqual(enriched_claims.UnitIDs, user_attributes.UnitIDs) ||
+				enriched_claims.IsInstructor != user_attributes.IsInstructor ||
+				enriched_claims.IsEvaluator != user_attributes.IsEvaluator ||
+				!reflect.DeepEqual(enriched_claims.MDSQualifications, user_attributes.MDSQualifications) {
+				t.Fatalf("expected the token's attributes to be replaced, got %+v", enriched_claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/thedanisaur/jfl_platform/password"
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+	"github.com/thedanisaur/jfl_platform/util"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+var ErrClientNotFound = types.NewPlatformError(ErrorKind.NotFound, "client_not_found", "client not found")
+
+// ClientLookup is implemented by the service that registers machine clients.
+type ClientLookup interface {
+	// GetClient returns ErrClientNotFound when there is no such client
+	GetClient(txid uuid.UUID, client_id string) (types.ServiceClient, error)
+}
+
+// ClientCredentialsHandler implements the OAuth 2.0 client credentials grant
+// (RFC 6749 section 4.4). Clients authenticate with Basic credentials and may
+// ask for a subset of their scopes with the `scope` form value.
+func ClientCredentialsHandler(config types.Config, key_ring *security.KeyRing, clients ClientLookup) fiber.Handler {
+	dummy_hash, err := password.Hash(util.RandomString(32), config)
+	if err != nil {
+		log.Fatalf("Could not generate dummy password hash: %s\n", err.Error())
+	}
+
+	return func(c *fiber.Ctx) error {
+		txid := uuid.New()
+		log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(ClientCredentialsHandler))
+		c.Locals("transaction_id", txid)
+
+		if c.FormValue("grant_type") != "client_credentials" {
+			return fiber.NewError(fiber.StatusBadRequest, "unsupported_grant_type")
+		}
+		client_id, client_secret, _, err := security.GetBasicAuth(c.Get(fiber.HeaderAuthorization), config)
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid_client")
+		}
+
+		client, err := clients.GetClient(txid, client_id)
+		if err != nil && !errors.Is(err, ErrClientNotFound) {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to issue token")
+		}
+		secret_hash := client.SecretHash
+		if errors.Is(err, ErrClientNotFound) {
+			secret_hash = dummy_hash
+		}
+		match, _, verify_err := password.Verify(client_secret, secret_hash, config)
+		if verify_err != nil {
+			log.Printf("%s | %s\n", txid.String(), verify_err.Error())
+		}
+		if err != nil || !match || client.Disabled {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid_client")
+		}
+
+		scopes := client.Scopes
+		requested_scopes := strings.Fields(c.FormValue("scope"))
+		if len(requested_scopes) > 0 {
+			if !security.HasScopes(client.Scopes, requested_scopes) {
+				return fiber.NewError(fiber.StatusBadRequest, "invalid_scope")
+			}
+			scopes = requested_scopes
+		}
+
+		client_claims := types.ClientClaims{
+			ClientID: client.ID,
+			Scopes:   scopes,
+		}
+		token, err := security.GenerateClientJWT(txid, client_claims, config, key_ring)
+		if err != nil {
+			log.Printf("%s | failed to generate token: %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to issue token")
+		}
+		expiration_ms := config.App.ClientExpirationMs
+		if expiration_ms == 0 {
+			expiration_ms = config.App.LoginExpirationMs
+		}
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return c.JSON(types.TokenResponse{
+			AccessToken: token,
+			TokenType:   "Bearer",
+			ExpiresIn:   expiration_ms / 1000,
+			Scope:       strings.Join(scopes, " "),
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"log"
+	"strings"
+
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/UserStatus"
+	"github.com/thedanisaur/jfl_platform/util"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// UserStatusLookup returns the current UserStatus of a user.
+type UserStatusLookup interface {
+	GetUserStatus(txid uuid.UUID, user_id uuid.UUID) (string, error)
+}
+
+// DiscoveryEndpoints are the paths the handlers are mounted on, relative to
+// Config.App.Host.Issuer.
+type DiscoveryEndpoints struct {
+	Token         string
+	JWKS          string
+	Introspection string
+}
+
+type DiscoveryDocument struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	TokenEndpoint                    string   `json:"token_endpoint,omitempty"`
+	IntrospectionEndpoint            string   `json:"introspection_endpoint,omitempty"`
+	GrantTypesSupported              []string `json:"grant_types_supported"`
+	TokenEndpointAuthMethods         []string `json:"token_endpoint_auth_methods_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                  []string `json:"claims_supported"`
+}
+
+func endpointURL(config types.Config, path string) string {
+	if path == "" {
+		return ""
+	}
+	return strings.TrimSuffix(config.App.Host.Issuer, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// DiscoveryHandler publishes an OpenID style discovery document so non Go
+// consumers can find the JWKS and the endpoints.
+func DiscoveryHandler(config types.Config, key_ring *security.KeyRing, endpoints DiscoveryEndpoints) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		document := DiscoveryDocument{
+			Issuer:                           config.App.Host.Issuer,
+			JWKSURI:                          endpointURL(config, endpoints.JWKS),
+			TokenEndpoint:                    endpointURL(config, endpoints.Token),
+			IntrospectionEndpoint:            endpointURL(config, endpoints.Introspection),
+			GrantTypesSupported:              []string{"client_credentials"},
+			TokenEndpointAuthMethods:         []string{"client_secret_basic"},
+			IDTokenSigningAlgValuesSupported: key_ring.Algorithms(),
+			ClaimsSupported:                  []string{"iss", "aud", "exp", "iat", "nbf", "jti", "sid", "amr", "auth_time", "user_id", "issuing_unit", "role_name", "unit_ids", "is_instructor", "is_evaluator", "mds_qualifications", "client_id", "scope"},
+		}
+		c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+		return c.JSON(document)
+	}
+}
+
+// JWKSHandler publishes the public half of every key on the ring, including
+// retiring keys, so tokens signed with them keep validating downstream.
+func JWKSHandler(key_ring *security.KeyRing) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+		return c.JSON(key_ring.JWKS())
+	}
+}
+
+// IntrospectionScope is the scope a client needs to introspect tokens
+const IntrospectionScope = "introspect"
+
+type IntrospectionOptions struct {
+	// RevocationStore reports revoked tokens as inactive when set
+	RevocationStore security.RevocationStore
+	// UserStatus reports tokens of users that aren't approved as inactive when set
+	UserStatus UserStatusLookup
+}
+
+// IntrospectionHandler implements RFC 7662. The endpoint reveals claims so only
+// machine clients may call it, RFC 7662 section 4. Mount it behind
+// AuthenticationMiddlewareWithClients and RequireClientScopes:
+//
+//	app.Post("/introspect", auth.RequireClientScopes(auth.IntrospectionScope), auth.IntrospectionHandler(config, key_ring, options))
+func IntrospectionHandler(config types.Config, key_ring *security.KeyRing, options IntrospectionOptions) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		txid, ok := c.Locals("transaction_id").(uuid.UUID)
+		if !ok {
+			txid = uuid.New()
+			c.Locals("transaction_id", txid)
+		}
+		log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(IntrospectionHandler))
+
+		token := c.FormValue("token")
+		if token == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid_request")
+		}
+		response := security.IntrospectToken(txid, token, config, key_ring, options.RevocationStore)
+		if response.Active && response.UserClaims != nil && options.UserStatus != nil {
+			status, err := options.UserStatus.GetUserStatus(txid, response.UserClaims.UserID)
+			if err != nil {
+				log.Printf("%s | %s\n", txid.String(), err.Error())
+				return fiber.NewError(fiber.StatusInternalServerError, "failed to introspect token")
+			}
+			if status != UserStatus.Approved {
+				log.Printf("%s | user %s is %s\n", txid.String(), response.UserClaims.UserID.String(), status)
+				response = types.IntrospectionResponse{Active: false}
+			}
+		}
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return c.JSON(response)
+	}
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestIntrospectionRequiresClientScope(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	user_token := testUserToken(t, testUserClaims(), config, key_ring)
+	client_token := func(scopes ...string) string {
+		token, err := security.GenerateClientJWT(uuid.New(), types.ClientClaims{ClientID: "gateway", Scopes: scopes}, config, key_ring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	app := testApp(
+		AuthenticationMiddlewareWithClients(config, key_ring, AuthenticationOptions{}),
+		RequireClientScopes(IntrospectionScope),
+		IntrospectionHandler(config, key_ring, IntrospectionOptions{}),
+	)
+
+	tests := []struct {
+		name   string
+		caller string
+		status int
+	}{
+		{"user token", user_token, fiber.StatusForbidden},
+		{"client without scope", client_token("read"), fiber.StatusForbidden},
+		{"client with scope", client_token("introspect"), fiber.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			form := url.Values{"token": {user_token}}
+			request := httptest.NewRequest(fiber.MethodPost, "/introspect", strings.NewReader(form.Encode()))
+			request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+			request.Header.Set(fiber.HeaderAuthorization, "Bearer "+test.caller)
+			response, err := app.Test(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, response.StatusCode, body)
+			}
+			if response.StatusCode != fiber.StatusOK {
+				challenge := response.Header.Get(fiber.HeaderWWWAuthenticate)
+				if challenge != `Bearer error="insufficient_scope", scope="introspect"` {
+					t.Fatalf("unexpected challenge %q", challenge)
+				}
+				return
+			}
+			var introspection types.IntrospectionResponse
+			err = json.Unmarshal(body, &introspection)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !introspection.Active {
+				t.Fatal("expected the token to be active")
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+	"github.com/thedanisaur/jfl_platform/types/UserStatus"
+	"github.com/thedanisaur/jfl_platform/util"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+var ErrImpersonationReadOnly = types.NewPlatformError(ErrorKind.Forbidden, "impersonation_read_only", "write not allowed while impersonating")
+
+type ImpersonationRequest struct {
+	UserID     uuid.UUID `json:"user_id"`
+	AllowWrite bool      `json:"allow_write"`
+	Reason     string    `json:"reason"`
+}
+
+// ImpersonationLookup loads the user being impersonated.
+type ImpersonationLookup interface {
+	// GetUserByID returns ErrUserNotFound when there is no such user
+	GetUserByID(txid uuid.UUID, user_id uuid.UUID) (types.UserResponse, error)
+}
+
+// ImpersonationHandler issues a token carrying the target user's claims with
+// the caller recorded in the `act` claim. Mount it behind
+// AuthenticationMiddleware, only roles in Config.App.Impersonation.AllowedRoles
+// may impersonate and they can't impersonate each other. The caller has to have
+// signed in themselves, impersonation and API key credentials are refused.
+func ImpersonationHandler(config types.Config, key_ring *security.KeyRing, users ImpersonationLookup, audit_logger AuditLogger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		txid, ok := c.Locals("transaction_id").(uuid.UUID)
+		if !ok {
+			txid = uuid.New()
+			c.Locals("transaction_id", txid)
+		}
+		log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(ImpersonationHandler))
+
+		admin_claims, ok := c.Locals("user_claims").(types.UserClaims)
+		if !ok {
+			return fiber.NewError(fiber.StatusUnauthorized, "not authenticated")
+		}
+		if admin_claims.Actor != nil || admin_claims.APIKeyID != "" {
+			return fiber.NewError(fiber.StatusForbidden, "impersonation requires a signed in user")
+		}
+		if !canImpersonate(admin_claims.RoleName, config) {
+			log.Printf("%s | role %s may not impersonate\n", txid.String(), admin_claims.RoleName)
+			return fiber.NewError(fiber.StatusForbidden, "not authorized")
+		}
+
+		var request ImpersonationRequest
+		err := c.BodyParser(&request)
+		if err != nil || request.UserID == uuid.Nil || request.Reason == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "user_id and reason are required")
+		}
+
+		user, err := users.GetUserByID(txid, request.UserID)
+		if errors.Is(err, ErrUserNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, "user not found")
+		}
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to impersonate")
+		}
+		if user.Status != UserStatus.Approved || canImpersonate(user.Role, config) {
+			return fiber.NewError(fiber.StatusForbidden, "user can't be impersonated")
+		}
+
+		user_claims := types.NewUserClaims(user)
+		// The admin is the one who authenticated
+		user_claims.AuthenticatedAt = admin_claims.AuthenticatedAt
+		user_claims.Actor = &types.ActorClaims{
+			UserID:     admin_claims.UserID,
+			RoleName:   admin_claims.RoleName,
+			AllowWrite: request.AllowWrite,
+		}
+		token, err := security.GenerateJWT(txid, user_claims, config, key_ring)
+		if err != nil {
+			log.Printf("%s | failed to generate token: %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to impersonate")
+		}
+
+		if audit_logger != nil {
+			audit_logger.Audit(types.AuditEvent{
+				TransactionID: txid,
+				Action:        "impersonation_started",
+				UserID:        user.ID,
+				ActorID:       &admin_claims.UserID,
+				Allowed:       true,
+				Detail:        request.Reason,
+				OccurredOn:    time.Now().UTC(),
+			})
+		}
+
+		expiration_ms := config.App.LoginExpirationMs
+		if config.App.Impersonation.ExpirationMs > 0 && config.App.Impersonation.ExpirationMs < expiration_ms {
+			expiration_ms = config.App.Impersonation.ExpirationMs
+		}
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return c.JSON(types.TokenResponse{
+			AccessToken: token,
+			TokenType:   "Bearer",
+			ExpiresIn:   expiration_ms / 1000,
+		})
+	}
+}
+
+func canImpersonate(role_name string, config types.Config) bool {
+	for _, allowed_role := range config.App.Impersonation.AllowedRoles {
+		if role_name == allowed_role {
+			return true
+		}
+	}
+	return false
+}
+
+// checkImpersonation audits every request made with an impersonation token
+// and blocks unsafe methods unless the admin explicitly asked for write access.
+func checkImpersonation(txid uuid.UUID, c *fiber.Ctx, user_claims types.UserClaims, audit_logger AuditLogger) error {
+	if user_claims.Actor == nil {
+		return nil
+	}
+	allowed := user_claims.Actor.AllowWrite || isSafeMethod(c.Method())
+	if audit_logger != nil {
+		audit_logger.Audit(types.AuditEvent{
+			TransactionID: txid,
+			Action:        "impersonated_request",
+			UserID:        user_claims.UserID,
+			ActorID:       &user_claims.Actor.UserID,
+			Method:        c.Method(),
+			Path:          c.Path(),
+			Allowed:       allowed,
+			OccurredOn:    time.Now().UTC(),
+		})
+	}
+	if !allowed {
+		log.Printf("%s | blocked write while impersonating\n", txid.String())
+		return ErrImpersonationReadOnly
+	}
+	return nil
+}
+
+func isSafeMethod(method string) bool {
+	return method == fiber.MethodGet || method == fiber.MethodHead || method == fiber.MethodOptions
+}
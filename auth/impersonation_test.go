@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/thedanisaur/jfl_platform/handler"
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestImpersonationRequiresASignedInUser(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	config.App.Impersonation.AllowedRoles = []string{"admin"}
+	users, user := newTestUsers(t, config)
+	api_key_store := security.NewMemoryAPIKeyStore()
+
+	admin_claims := testUserClaims()
+	admin_claims.RoleName = "admin"
+	api_key, _, err := security.GenerateAPIKey(uuid.New(), "integration", admin_claims, nil, nil, nil, api_key_store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write access so the middleware lets the POST through to the handler
+	impersonated_claims := testUserClaims()
+	impersonated_claims.RoleName = "admin"
+	impersonated_claims.Actor = &types.ActorClaims{UserID: uuid.New(), RoleName: "admin", AllowWrite: true}
+
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/impersonate",
+		AuthenticationMiddleware(config, key_ring, AuthenticationOptions{APIKeyStore: api_key_store}),
+		ImpersonationHandler(config, key_ring, users, nil),
+	)
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"admin token", fiber.HeaderAuthorization, "Bearer " + testUserToken(t, admin_claims, config, key_ring), fiber.StatusOK},
+		{"admin api key", security.HeaderAPIKey, api_key, fiber.StatusForbidden},
+		{"impersonation token", fiber.HeaderAuthorization, "Bearer " + testUserToken(t, impersonated_claims, config, key_ring), fiber.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := `{"user_id":"` + user.ID.String() + `","reason":"support ticket"}`
+			request := httptest.NewRequest(fiber.MethodPost, "/impersonate", strings.NewReader(body))
+			request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			request.Header.Set(test.header, test.value)
+			status, body := testSend(t, app, request)
+			if status != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, status, body)
+			}
+		})
+	}
+}
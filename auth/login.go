@@ -0,0 +1,351 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/password"
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/AuthenticationMethod"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+	"github.com/thedanisaur/jfl_platform/types/UserStatus"
+	"github.com/thedanisaur/jfl_platform/util"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+var ErrUserNotFound = types.NewPlatformError(ErrorKind.NotFound, "user_not_found", "user not found")
+
+// Second factor headers, sent alongside the Basic credentials
+const HeaderOTP = "X-OTP"
+const HeaderRecoveryCode = "X-Recovery-Code"
+
+const default_basic_realm = "jfl"
+const default_failure_window_ms = 15 * 60 * 1000
+
+// UserLookup is implemented by the service that owns the users table.
+type UserLookup interface {
+	// GetUserByUsername returns ErrUserNotFound when there is no such user
+	GetUserByUsername(txid uuid.UUID, username string) (types.UserResponse, error)
+	UpdateLastLoggedIn(txid uuid.UUID, user_id uuid.UUID, last_logged_in time.Time) error
+	UpdatePasswordHash(txid uuid.UUID, user_id uuid.UUID, password_hash string) error
+}
+
+// MFALookup is implemented by services that let users enroll in TOTP.
+type MFALookup interface {
+	// GetTOTPSecret returns an empty secret when the user hasn't enrolled
+	GetTOTPSecret(txid uuid.UUID, user_id uuid.UUID) (string, error)
+	GetRecoveryCodeHashes(txid uuid.UUID, user_id uuid.UUID) ([]string, error)
+	DeleteRecoveryCodeHash(txid uuid.UUID, user_id uuid.UUID, code_hash string) error
+}
+
+type LoginOptions struct {
+	// AttemptStore enables per account lockout after Config.App.Lockout.MaxAttempts failures
+	AttemptStore security.LoginAttemptStore
+	// MFA requires enrolled users to pass a TOTP or recovery code
+	MFA MFALookup
+	// TOTPReplayStore prevents a TOTP code from being used twice
+	TOTPReplayStore security.TOTPReplayStore
+	// RefreshTokenStore adds a refresh token to the response when set
+	RefreshTokenStore security.RefreshTokenStore
+	// SessionRegistry enforces Config.App.MaxSessions when set
+	SessionRegistry *security.SessionRegistry
+	// CSRFTokenStore holds synchronizer tokens when Config.App.Cookie.CSRFMode is synchronizer
+	CSRFTokenStore security.CSRFTokenStore
+}
+
+// LoginHandler authenticates Basic credentials and responds with a
+// types.TokenResponse.
+func LoginHandler(config types.Config, key_ring *security.KeyRing, users UserLookup, options LoginOptions) fiber.Handler {
+	// Unknown users are checked against a throwaway hash so response times
+	// don't reveal which usernames exist
+	dummy_hash, err := password.Hash(util.RandomString(32), config)
+	if err != nil {
+		log.Fatalf("Could not generate dummy password hash: %s\n", err.Error())
+	}
+
+	return func(c *fiber.Ctx) error {
+		txid := uuid.New()
+		log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(LoginHandler))
+		c.Locals("transaction_id", txid)
+
+		username, passwd, _, err := security.GetBasicAuth(c.Get(fiber.HeaderAuthorization), config)
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return basicChallenge(c, config, fiber.NewError(fiber.StatusUnauthorized, "invalid credentials"))
+		}
+
+		user, err := users.GetUserByUsername(txid, username)
+		if err != nil && !errors.Is(err, ErrUserNotFound) {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to login")
+		}
+		password_hash := user.PasswordHash
+		account := lockoutKey(user.ID)
+		if errors.Is(err, ErrUserNotFound) {
+			password_hash = dummy_hash
+			account = "username:" + username
+		}
+		lockout_err := checkLockout(txid, c, account, options.AttemptStore)
+		if lockout_err != nil {
+			return lockout_err
+		}
+		match, needs_rehash, verify_err := password.Verify(passwd, password_hash, config)
+		if verify_err != nil {
+			log.Printf("%s | %s\n", txid.String(), verify_err.Error())
+		}
+		if err != nil || !match {
+			recordFailedLogin(txid, account, config, options.AttemptStore)
+			return basicChallenge(c, config, fiber.NewError(fiber.StatusUnauthorized, "invalid credentials"))
+		}
+
+		if user.Status != UserStatus.Approved {
+			log.Printf("%s | user %s is %s\n", txid.String(), user.ID.String(), user.Status)
+			return fiber.NewError(fiber.StatusForbidden, "account not approved")
+		}
+
+		// The password was right, asking for Basic credentials again would
+		// make browsers prompt for them instead of the second factor
+		authentication_methods, err := verifySecondFactor(txid, c, user.ID, config, options)
+		if err != nil {
+			return err
+		}
+
+		resetLockout(txid, user.ID, options.AttemptStore)
+		if needs_rehash {
+			rehashPassword(txid, user.ID, passwd, config, users)
+		}
+		err = users.UpdateLastLoggedIn(txid, user.ID, time.Now().UTC())
+		if err != nil {
+			log.Printf("%s | failed to update last logged in: %s\n", txid.String(), err.Error())
+		}
+
+		user_claims := types.NewUserClaims(user)
+		user_claims.AuthenticationMethods = authentication_methods
+		user_claims.AuthenticatedAt = time.Now().UTC()
+		return issueTokens(txid, c, user_claims, config, key_ring, options)
+	}
+}
+
+func issueTokens(txid uuid.UUID, c *fiber.Ctx, user_claims types.UserClaims, config types.Config, key_ring *security.KeyRing, options LoginOptions) error {
+	if options.SessionRegistry != nil {
+		err := options.SessionRegistry.Register(txid, c, &user_claims, config)
+		if errors.Is(err, security.ErrMaxSessions) {
+			return fiber.NewError(fiber.StatusConflict, err.Error())
+		}
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to login")
+		}
+	}
+
+	// Cookie sessions need a session to bind synchronizer tokens to
+	if config.App.Cookie.Enabled && user_claims.SessionID == uuid.Nil {
+		user_claims.SessionID = uuid.New()
+	}
+
+	var response types.TokenResponse
+	var err error
+	if options.RefreshTokenStore != nil {
+		response, err = security.GenerateTokenPair(txid, user_claims, config, key_ring, options.RefreshTokenStore)
+	} else {
+		response.AccessToken, err = security.GenerateJWT(txid, user_claims, config, key_ring)
+		response.TokenType = "Bearer"
+		response.ExpiresIn = config.App.LoginExpirationMs / 1000
+	}
+	if err != nil {
+		log.Printf("%s | failed to generate token: %s\n", txid.String(), err.Error())
+		releaseSession(txid, user_claims, options)
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to login")
+	}
+	if config.App.Cookie.Enabled {
+		err = useCookieSession(txid, c, user_claims, &response, config, options)
+		if err != nil {
+			releaseSession(txid, user_claims, options)
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to login")
+		}
+	}
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(response)
+}
+
+// releaseSession removes a session registered for a login that failed, so it
+// doesn't count towards Config.App.MaxSessions.
+func releaseSession(txid uuid.UUID, user_claims types.UserClaims, options LoginOptions) {
+	if options.SessionRegistry == nil {
+		return
+	}
+	err := options.SessionRegistry.Revoke(txid, user_claims.UserID, user_claims.SessionID)
+	if err != nil {
+		log.Printf("%s | failed to release session: %s\n", txid.String(), err.Error())
+	}
+}
+
+// basicChallenge asks for Basic credentials again when err is a 401, RFC 7617.
+// The realm is the issuer.
+func basicChallenge(c *fiber.Ctx, config types.Config, err error) error {
+	var fiber_error *fiber.Error
+	if !errors.As(err, &fiber_error) || fiber_error.Code != fiber.StatusUnauthorized {
+		return err
+	}
+	realm := config.App.Host.Issuer
+	if realm == "" {
+		realm = default_basic_realm
+	}
+	c.Set(fiber.HeaderWWWAuthenticate, fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, realm))
+	return err
+}
+
+// useCookieSession issues a fresh CSRF token for the session and moves the
+// tokens into cookies, every response that sets the session cookie goes
+// through here.
+func useCookieSession(txid uuid.UUID, c *fiber.Ctx, user_claims types.UserClaims, response *types.TokenResponse, config types.Config, options LoginOptions) error {
+	expires_at := time.Now().UTC().Add(time.Duration(config.App.LoginExpirationMs) * time.Millisecond)
+	_, err := security.IssueCSRFToken(txid, c, user_claims, expires_at, config, options.CSRFTokenStore)
+	if err != nil {
+		log.Printf("%s | failed to issue csrf token: %s\n", txid.String(), err.Error())
+		return err
+	}
+	useSessionCookie(c, response, expires_at, config)
+	return nil
+}
+
+// useSessionCookie moves the access and refresh tokens into HttpOnly cookies,
+// the page never sees either token in cookie mode. Refresh handlers read the
+// token back with security.RefreshCookieToken.
+func useSessionCookie(c *fiber.Ctx, response *types.TokenResponse, expires_at time.Time, config types.Config) {
+	security.SetSessionCookie(c, response.AccessToken, expires_at, config)
+	response.AccessToken = ""
+	response.TokenType = "Cookie"
+	if response.RefreshToken != "" {
+		refresh_expires_at := time.Now().UTC().Add(time.Duration(config.App.RefreshExpirationMs) * time.Millisecond)
+		security.SetRefreshCookie(c, response.RefreshToken, refresh_expires_at, config)
+		response.RefreshToken = ""
+	}
+}
+
+// verifySecondFactor returns the `amr` values for the login, users that
+// haven't enrolled in MFA have only used their password.
+func verifySecondFactor(txid uuid.UUID, c *fiber.Ctx, user_id uuid.UUID, config types.Config, options LoginOptions) ([]string, error) {
+	authentication_methods := []string{AuthenticationMethod.Password}
+	if options.MFA == nil {
+		return authentication_methods, nil
+	}
+	secret, err := options.MFA.GetTOTPSecret(txid, user_id)
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "failed to login")
+	}
+	if secret == "" {
+		return authentication_methods, nil
+	}
+
+	code := c.Get(HeaderOTP)
+	recovery_code := c.Get(HeaderRecoveryCode)
+	switch {
+	case code != "":
+		ok, err := security.VerifyTOTP(txid, user_id, secret, code, config, options.TOTPReplayStore)
+		if err != nil && !errors.Is(err, security.ErrTOTPReplayed) {
+			return nil, fiber.NewError(fiber.StatusInternalServerError, "failed to login")
+		}
+		if !ok {
+			recordFailedLogin(txid, lockoutKey(user_id), config, options.AttemptStore)
+			return nil, fiber.NewError(fiber.StatusUnauthorized, "invalid one-time password")
+		}
+	case recovery_code != "":
+		hashes, err := options.MFA.GetRecoveryCodeHashes(txid, user_id)
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return nil, fiber.NewError(fiber.StatusInternalServerError, "failed to login")
+		}
+		code_hash, ok := security.MatchRecoveryCode(recovery_code, hashes)
+		if !ok {
+			recordFailedLogin(txid, lockoutKey(user_id), config, options.AttemptStore)
+			return nil, fiber.NewError(fiber.StatusUnauthorized, "invalid recovery code")
+		}
+		err = options.MFA.DeleteRecoveryCodeHash(txid, user_id, code_hash)
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return nil, fiber.NewError(fiber.StatusInternalServerError, "failed to login")
+		}
+		log.Printf("%s | user %s logged in with a recovery code\n", txid.String(), user_id.String())
+	default:
+		// The password was right, tell the client to prompt for the second factor
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "mfa required")
+	}
+	return append(authentication_methods, AuthenticationMethod.OneTimePassword, AuthenticationMethod.MultiFactor), nil
+}
+
+// lockoutKey is the account login attempts are counted by. Users are counted
+// by id so every handler agrees whichever username they logged in with,
+// unknown usernames are counted by name so they lock out like real accounts.
+func lockoutKey(user_id uuid.UUID) string {
+	return "user:" + user_id.String()
+}
+
+func resetLockout(txid uuid.UUID, user_id uuid.UUID, store security.LoginAttemptStore) {
+	if store == nil {
+		return
+	}
+	err := store.Reset(lockoutKey(user_id))
+	if err != nil {
+		log.Printf("%s | failed to reset login attempts: %s\n", txid.String(), err.Error())
+	}
+}
+
+// checkLockout answers 429 with Retry-After while the account is locked.
+func checkLockout(txid uuid.UUID, c *fiber.Ctx, username string, store security.LoginAttemptStore) error {
+	if store == nil {
+		return nil
+	}
+	locked_until, err := store.LockedUntil(username)
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to login")
+	}
+	if !locked_until.IsZero() {
+		log.Printf("%s | account locked until %s\n", txid.String(), locked_until.Format(time.RFC3339))
+		c.Set(fiber.HeaderRetryAfter, fmt.Sprintf("%d", int(time.Until(locked_until).Seconds())+1))
+		return fiber.NewError(fiber.StatusTooManyRequests, "account locked")
+	}
+	return nil
+}
+
+func recordFailedLogin(txid uuid.UUID, username string, config types.Config, store security.LoginAttemptStore) {
+	if store == nil || config.App.Lockout.MaxAttempts <= 0 {
+		return
+	}
+	window_ms := config.App.Lockout.FailureWindowMs
+	if window_ms <= 0 {
+		window_ms = default_failure_window_ms
+	}
+	failures, err := store.RecordFailure(username, time.Duration(window_ms)*time.Millisecond)
+	if err != nil {
+		log.Printf("%s | failed to record login failure: %s\n", txid.String(), err.Error())
+		return
+	}
+	if failures >= config.App.Lockout.MaxAttempts {
+		locked_until := time.Now().UTC().Add(time.Duration(config.App.Lockout.DurationMs) * time.Millisecond)
+		log.Printf("%s | locking account after %d failed attempts\n", txid.String(), failures)
+		err = store.Lock(username, locked_until)
+		if err != nil {
+			log.Printf("%s | failed to lock account: %s\n", txid.String(), err.Error())
+		}
+	}
+}
+
+func rehashPassword(txid uuid.UUID, user_id uuid.UUID, passwd string, config types.Config, users UserLookup) {
+	password_hash, err := password.Hash(passwd, config)
+	if err != nil {
+		log.Printf("%s | failed to rehash password: %s\n", txid.String(), err.Error())
+		return
+	}
+	err = users.UpdatePasswordHash(txid, user_id, password_hash)
+	if err != nil {
+		log.Printf("%s | failed to store rehashed password: %s\n", txid.String(), err.Error())
+	}
+}
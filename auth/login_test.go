@@ -0,0 +1,401 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/handler"
+	"github.com/thedanisaur/jfl_platform/password"
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/CSRFMode"
+	"github.com/thedanisaur/jfl_platform/types/SessionLimitPolicy"
+	"github.com/thedanisaur/jfl_platform/types/UserStatus"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const test_password = "correct horse battery staple"
+
+// testUsers is an in memory UserLookup keyed by email.
+type testUsers struct {
+	users map[string]types.UserResponse
+}
+
+func newTestUsers(t *testing.T, config types.Config) (*testUsers, types.UserResponse) {
+	t.Helper()
+	password_hash, err := password.Hash(test_password, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := types.UserResponse{
+		ID:           uuid.New(),
+		Email:        "pilot@jfl.test",
+		PasswordHash: password_hash,
+		IssuingUnit:  "unit",
+		Role:         "role",
+		Status:       UserStatus.Approved,
+	}
+	return &testUsers{users: map[string]types.UserResponse{user.Email: user}}, user
+}
+
+func (users *testUsers) GetUserByUsername(txid uuid.UUID, username string) (types.UserResponse, error) {
+	user, ok := users.users[username]
+	if !ok {
+		return types.UserResponse{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (users *testUsers) GetUserByID(txid uuid.UUID, user_id uuid.UUID) (types.UserResponse, error) {
+	for _, user := range users.users {
+		if user.ID == user_id {
+			return user, nil
+		}
+	}
+	return types.UserResponse{}, ErrUserNotFound
+}
+
+func (users *testUsers) UpdateLastLoggedIn(txid uuid.UUID, user_id uuid.UUID, last_logged_in time.Time) error {
+	return nil
+}
+
+func (users *testUsers) UpdatePasswordHash(txid uuid.UUID, user_id uuid.UUID, password_hash string) error {
+	for email, user := range users.users {
+		if user.ID == user_id {
+			user.PasswordHash = password_hash
+			users.users[email] = user
+		}
+	}
+	return nil
+}
+
+// testPasswordConfig keeps argon2id cheap enough for tests.
+func testPasswordConfig() types.Config {
+	config := testConfig()
+	config.App.Password.Argon2id.MemoryKiB = 1024
+	config.App.Password.Argon2id.Iterations = 1
+	config.App.Password.Argon2id.Parallelism = 1
+	return config
+}
+
+func testLoginRequest(username string, passwd string) *http.Request {
+	request := httptest.NewRequest(fiber.MethodPost, "/login", nil)
+	request.Header.Set(fiber.HeaderAuthorization, "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+passwd)))
+	return request
+}
+
+func responseCookie(response *http.Response, name string) *http.Cookie {
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestLoginCookieModeKeepsTokensOutOfTheBody(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testPasswordConfig()
+	config.App.Cookie.Enabled = true
+	config.App.Cookie.CSRFMode = CSRFMode.DoubleSubmit
+	config.App.Cookie.RefreshPath = "/refresh"
+	users, _ := newTestUsers(t, config)
+	refresh_token_store := security.NewMemoryRefreshTokenStore()
+
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/login", LoginHandler(config, key_ring, users, LoginOptions{RefreshTokenStore: refresh_token_store}))
+	app.Post("/refresh", func(c *fiber.Ctx) error {
+		response, err := security.RotateRefreshToken(uuid.New(), security.RefreshCookieToken(c, config), config, key_ring, refresh_token_store)
+		if err != nil {
+			return err
+		}
+		return c.JSON(response)
+	})
+
+	response, err := app.Test(testLoginRequest("pilot@jfl.test", test_password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", response.StatusCode)
+	}
+	var body types.TokenResponse
+	err = json.NewDecoder(response.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.AccessToken != "" || body.RefreshToken != "" {
+		t.Fatalf("tokens leaked into the body: %+v", body)
+	}
+
+	refresh_cookie := responseCookie(response, "jfl_refresh")
+	if refresh_cookie == nil || refresh_cookie.Value == "" {
+		t.Fatal("missing refresh cookie")
+	}
+	if !refresh_cookie.HttpOnly || !refresh_cookie.Secure || refresh_cookie.Path != "/refresh" {
+		t.Fatalf("refresh cookie must be HttpOnly, Secure and scoped to the refresh path: %+v", refresh_cookie)
+	}
+	if refresh_cookie.SameSite == http.SameSiteDefaultMode {
+		t.Fatal("refresh cookie must set SameSite")
+	}
+
+	request := httptest.NewRequest(fiber.MethodPost, "/refresh", nil)
+	request.AddCookie(&http.Cookie{Name: refresh_cookie.Name, Value: refresh_cookie.Value})
+	status, body_string := testSend(t, app, request)
+	if status != fiber.StatusOK {
+		t.Fatalf("refresh with the cookie failed: %d %s", status, body_string)
+	}
+}
+
+func TestLoginChallengesWithBasic(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testPasswordConfig()
+	users, user := newTestUsers(t, config)
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/login", LoginHandler(config, key_ring, users, LoginOptions{}))
+
+	missing := httptest.NewRequest(fiber.MethodPost, "/login", nil)
+	for _, request := range []*http.Request{missing, testLoginRequest(user.Email, "wrong"), testLoginRequest("nobody@jfl.test", test_password)} {
+		response, err := app.Test(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != fiber.StatusUnauthorized {
+			t.Fatalf("expected 401, got %d", response.StatusCode)
+		}
+		challenge := response.Header.Get(fiber.HeaderWWWAuthenticate)
+		if challenge != `Basic realm="https://jfl.test", charset="UTF-8"` {
+			t.Fatalf("unexpected challenge %q", challenge)
+		}
+	}
+}
+
+// testMFA enrolls every user with the same TOTP secret and no recovery codes.
+type testMFA struct {
+	secret string
+}
+
+func (mfa testMFA) GetTOTPSecret(txid uuid.UUID, user_id uuid.UUID) (string, error) {
+	return mfa.secret, nil
+}
+
+func (mfa testMFA) GetRecoveryCodeHashes(txid uuid.UUID, user_id uuid.UUID) ([]string, error) {
+	return nil, nil
+}
+
+func (mfa testMFA) DeleteRecoveryCodeHash(txid uuid.UUID, user_id uuid.UUID, code_hash string) error {
+	return nil
+}
+
+func TestLoginSecondFactorIsNotABasicChallenge(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testPasswordConfig()
+	users, user := newTestUsers(t, config)
+	secret, err := security.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/login", LoginHandler(config, key_ring, users, LoginOptions{MFA: testMFA{secret: secret}}))
+
+	wrong_code := testLoginRequest(user.Email, test_password)
+	wrong_code.Header.Set(HeaderOTP, "000000x")
+	tests := []struct {
+		name      string
+		request   *http.Request
+		challenge string
+	}{
+		{"wrong password", testLoginRequest(user.Email, "wrong"), `Basic realm="https://jfl.test", charset="UTF-8"`},
+		{"mfa required", testLoginRequest(user.Email, test_password), ""},
+		{"wrong one-time password", wrong_code, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := app.Test(test.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != fiber.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d", response.StatusCode)
+			}
+			challenge := response.Header.Get(fiber.HeaderWWWAuthenticate)
+			if challenge != test.challenge {
+				t.Fatalf("expected challenge %q, got %q", test.challenge, challenge)
+			}
+		})
+	}
+}
+
+func TestLoginRehashesLegacyHash(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testPasswordConfig()
+	users, user := newTestUsers(t, config)
+	bcrypt_hash, err := bcrypt.GenerateFromPassword([]byte(test_password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.PasswordHash = string(bcrypt_hash)
+	users.users[user.Email] = user
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/login", LoginHandler(config, key_ring, users, LoginOptions{}))
+
+	// A wrong password leaves the hash alone
+	testSend(t, app, testLoginRequest(user.Email, "wrong"))
+	if users.users[user.Email].PasswordHash != string(bcrypt_hash) {
+		t.Fatal("a failed login must not rehash")
+	}
+	status, body := testSend(t, app, testLoginRequest(user.Email, test_password))
+	if status != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", status, body)
+	}
+	password_hash := users.users[user.Email].PasswordHash
+	if !strings.HasPrefix(password_hash, "$argon2id$") {
+		t.Fatalf("expected the bcrypt hash to be replaced with argon2id, got %q", password_hash)
+	}
+	status, body = testSend(t, app, testLoginRequest(user.Email, test_password))
+	if status != fiber.StatusOK {
+		t.Fatalf("expected the rehashed password to log in, got %d: %s", status, body)
+	}
+	if users.users[user.Email].PasswordHash != password_hash {
+		t.Fatal("a current hash must not be rehashed again")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testPasswordConfig()
+	config.App.Lockout.MaxAttempts = 3
+	config.App.Lockout.DurationMs = 60000
+	users, user := newTestUsers(t, config)
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/login", LoginHandler(config, key_ring, users, LoginOptions{AttemptStore: security.NewMemoryLoginAttemptStore()}))
+
+	// A successful login starts the count over
+	for i := 0; i < config.App.Lockout.MaxAttempts-1; i++ {
+		testSend(t, app, testLoginRequest(user.Email, "wrong"))
+	}
+	status, body := testSend(t, app, testLoginRequest(user.Email, test_password))
+	if status != fiber.StatusOK {
+		t.Fatalf("expected 200 before the limit, got %d: %s", status, body)
+	}
+	for i := 0; i < config.App.Lockout.MaxAttempts-1; i++ {
+		testSend(t, app, testLoginRequest(user.Email, "wrong"))
+	}
+	status, body = testSend(t, app, testLoginRequest(user.Email, test_password))
+	if status != fiber.StatusOK {
+		t.Fatalf("expected the count to have been reset, got %d: %s", status, body)
+	}
+
+	// Unknown usernames lock the same way, so locks don't reveal accounts,
+	// and their count ignores case
+	tests := []struct {
+		username string
+		retry    string
+	}{
+		{user.Email, user.Email},
+		{"nobody@jfl.test", "NOBODY@jfl.test"},
+	}
+	for _, test := range tests {
+		for i := 0; i < config.App.Lockout.MaxAttempts; i++ {
+			status, _ = testSend(t, app, testLoginRequest(test.username, "wrong"))
+			if status != fiber.StatusUnauthorized {
+				t.Fatalf("expected 401 for %s before the lock, got %d", test.username, status)
+			}
+		}
+		response, err := app.Test(testLoginRequest(test.retry, test_password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != fiber.StatusTooManyRequests {
+			t.Fatalf("expected %s to be locked, got %d", test.retry, response.StatusCode)
+		}
+		retry_after, err := strconv.Atoi(response.Header.Get(fiber.HeaderRetryAfter))
+		if err != nil || retry_after < 1 || retry_after > 61 {
+			t.Fatalf("unexpected Retry-After %q", response.Header.Get(fiber.HeaderRetryAfter))
+		}
+	}
+}
+
+func TestLoginLockoutExpires(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testPasswordConfig()
+	config.App.Lockout.MaxAttempts = 1
+	config.App.Lockout.DurationMs = 50
+	users, user := newTestUsers(t, config)
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/login", LoginHandler(config, key_ring, users, LoginOptions{AttemptStore: security.NewMemoryLoginAttemptStore()}))
+
+	testSend(t, app, testLoginRequest(user.Email, "wrong"))
+	status, _ := testSend(t, app, testLoginRequest(user.Email, test_password))
+	if status != fiber.StatusTooManyRequests {
+		t.Fatalf("expected the account to be locked, got %d", status)
+	}
+	time.Sleep(100 * time.Millisecond)
+	status, body := testSend(t, app, testLoginRequest(user.Email, test_password))
+	if status != fiber.StatusOK {
+		t.Fatalf("expected the lock to expire, got %d: %s", status, body)
+	}
+}
+
+func TestLoginReleasesSessionWhenTokensFail(t *testing.T) {
+	config := testPasswordConfig()
+	config.App.MaxSessions = 1
+	config.App.SessionLimitPolicy = SessionLimitPolicy.Reject
+	users, user := newTestUsers(t, config)
+	registry, err := security.NewSessionRegistry(security.NewMemorySessionStore(), security.NewMemoryRevocationStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := LoginOptions{SessionRegistry: registry}
+
+	// A ring without a signing key fails after the session was registered
+	broken := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	broken.Post("/login", LoginHandler(config, security.NewKeyRing(), users, options))
+	status, _ := testSend(t, broken, testLoginRequest(user.Email, test_password))
+	if status != fiber.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", status)
+	}
+	sessions, err := registry.List(uuid.New(), types.UserClaims{UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("expected the session to be released, got %d", len(sessions))
+	}
+
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/login", LoginHandler(config, testKeyRing(t), users, options))
+	status, body := testSend(t, app, testLoginRequest(user.Email, test_password))
+	if status != fiber.StatusOK {
+		t.Fatalf("expected the user to log in, got %d: %s", status, body)
+	}
+}
+
+func TestLoginFailuresAgeOut(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testPasswordConfig()
+	config.App.Lockout.MaxAttempts = 2
+	config.App.Lockout.DurationMs = 60000
+	config.App.Lockout.FailureWindowMs = 50
+	users, user := newTestUsers(t, config)
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/login", LoginHandler(config, key_ring, users, LoginOptions{AttemptStore: security.NewMemoryLoginAttemptStore()}))
+
+	// Typos far apart never add up to a lock
+	testSend(t, app, testLoginRequest(user.Email, "wrong"))
+	time.Sleep(100 * time.Millisecond)
+	testSend(t, app, testLoginRequest(user.Email, "wrong"))
+	status, body := testSend(t, app, testLoginRequest(user.Email, test_password))
+	if status != fiber.StatusOK {
+		t.Fatalf("expected old failures to be forgotten, got %d: %s", status, body)
+	}
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/handler"
+	"github.com/thedanisaur/jfl_platform/types/MutualTLSMode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// testCertificates returns a CA pool, a server certificate for 127.0.0.1 and
+// a client certificate whose common name is the user id, all from one CA.
+func testCertificates(t *testing.T, user_id uuid.UUID) (*x509.CertPool, tls.Certificate, tls.Certificate) {
+	t.Helper()
+	ca_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca_template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "jfl test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	ca_der, err := x509.CreateCertificate(rand.Reader, ca_template, ca_template, &ca_key.PublicKey, ca_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca_certificate, err := x509.ParseCertificate(ca_der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca_certificate)
+
+	issue := func(serial int64, template *x509.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca_certificate, &key.PublicKey, ca_key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	server_certificate := issue(2, &x509.Certificate{IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}}, x509.ExtKeyUsageServerAuth)
+	client_certificate := issue(3, &x509.Certificate{Subject: pkix.Name{CommonName: user_id.String(), OrganizationalUnit: []string{"unit"}}}, x509.ExtKeyUsageClientAuth)
+	return pool, server_certificate, client_certificate
+}
+
+// testTLSSend serves app over TLS like ServerTLSConfig does for the optional
+// certificate mode and sends one request, with the client certificate if given.
+func testTLSSend(t *testing.T, app *fiber.App, pool *x509.CertPool, server_certificate tls.Certificate, authorization string, client_certificates ...tls.Certificate) (int, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{server_certificate},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}))
+	defer app.Shutdown()
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      pool,
+				Certificates: client_certificates,
+				MinVersion:   tls.VersionTLS12,
+			},
+		},
+	}
+	request, err := http.NewRequest(fiber.MethodGet, "https://"+listener.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		request.Header.Set(fiber.HeaderAuthorization, authorization)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, string(body)
+}
+
+func TestAuthenticationWithClientCertificates(t *testing.T) {
+	key_ring := testKeyRing(t)
+	user_claims := testUserClaims()
+	pool, server_certificate, client_certificate := testCertificates(t, user_claims.UserID)
+	user_token := "Bearer " + testUserToken(t, user_claims, testConfig(), key_ring)
+	other_token := "Bearer " + testUserToken(t, testUserClaims(), testConfig(), key_ring)
+
+	tests := []struct {
+		name          string
+		mode          string
+		authorization string
+		certificate   bool
+		status        int
+	}{
+		{"certificate", MutualTLSMode.Certificate, "", true, fiber.StatusOK},
+		{"certificate mode without a certificate", MutualTLSMode.Certificate, "", false, fiber.StatusUnauthorized},
+		{"certificate mode ignores the token", MutualTLSMode.Certificate, user_token, false, fiber.StatusUnauthorized},
+		{"certificate and matching token", MutualTLSMode.CertificateAndJWT, user_token, true, fiber.StatusOK},
+		{"certificate and another user's token", MutualTLSMode.CertificateAndJWT, other_token, true, fiber.StatusUnauthorized},
+		{"token without the certificate", MutualTLSMode.CertificateAndJWT, user_token, false, fiber.StatusUnauthorized},
+		{"certificate instead of a token", MutualTLSMode.CertificateOrJWT, "", true, fiber.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.App.MutualTLS.Mode = test.mode
+			config.App.MutualTLS.Mapping = map[string]string{
+				"user_id":      "subject_cn",
+				"issuing_unit": "subject_ou",
+				"role_name":    "literal:role",
+			}
+			app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler, DisableStartupMessage: true})
+			app.Use(AuthenticationMiddleware(config, key_ring, AuthenticationOptions{ClientCAs: pool}))
+			app.Get("/", func(c *fiber.Ctx) error {
+				return c.SendString("ok")
+			})
+			var certificates []tls.Certificate
+			if test.certificate {
+				certificates = append(certificates, client_certificate)
+			}
+			status, body := testTLSSend(t, app, pool, server_certificate, test.authorization, certificates...)
+			if status != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, status, body)
+			}
+		})
+	}
+}
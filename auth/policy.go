@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/util"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// PolicyStore is implemented by the service that owns the permissions table.
+type PolicyStore interface {
+	// GetPolicies returns the caller's policies for the resource and operation,
+	// an empty list denies
+	GetPolicies(txid uuid.UUID, user_claims types.UserClaims, resource string, operation string) ([]types.PermissionDTO, error)
+}
+
+// RecordLoader loads the record a write is evaluated against, i.e. the
+// existing row for an update.
+type RecordLoader func(c *fiber.Ctx) (map[string]interface{}, error)
+
+// AuthorizeRead compiles the caller's policies for the resource and operation
+// to a SQL filter and stores it for the handler, see AuthorizationFilter. scope
+// maps the CEL table aliases to SQL tables, i.e. {"log": "flight_logs"}. The
+// decisions for impersonation tokens are sent to audit_logger when it is set.
+// Mount it after AuthenticationMiddleware.
+func AuthorizeRead(store PolicyStore, resource string, operation string, scope map[string]string, audit_logger AuditLogger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		txid := transactionID(c)
+		log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(AuthorizeRead))
+
+		err := authorizeRead(txid, c, store, resource, operation, scope)
+		auditAuthorization(txid, c, resource, operation, err, audit_logger)
+		if err != nil {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+func authorizeRead(txid uuid.UUID, c *fiber.Ctx, store PolicyStore, resource string, operation string, scope map[string]string) error {
+	user_claims, policies, err := loadPolicies(txid, c, store, resource, operation)
+	if err != nil {
+		return err
+	}
+	filter, args, err := EvaluateRead(txid, resource, operation, scope, user_claims, policies)
+	if err != nil {
+		return authorizationError(txid, "evaluate policies", err)
+	}
+	c.Locals("authorization_filter", filter)
+	c.Locals("authorization_args", args)
+	return nil
+}
+
+// AuthorizeWrite evaluates the caller's policies for the resource and
+// operation against the record and rejects the request unless they allow it.
+// A nil loader evaluates against the JSON request body. The decisions for
+// impersonation tokens are sent to audit_logger when it is set. Mount it after
+// AuthenticationMiddleware.
+func AuthorizeWrite(store PolicyStore, resource string, operation string, loader RecordLoader, audit_logger AuditLogger) fiber.Handler {
+	if loader == nil {
+		loader = requestBodyRecord
+	}
+	return func(c *fiber.Ctx) error {
+		txid := transactionID(c)
+		log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(AuthorizeWrite))
+
+		err := authorizeWrite(txid, c, store, resource, operation, loader)
+		auditAuthorization(txid, c, resource, operation, err, audit_logger)
+		if err != nil {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+func authorizeWrite(txid uuid.UUID, c *fiber.Ctx, store PolicyStore, resource string, operation string, loader RecordLoader) error {
+	user_claims, policies, err := loadPolicies(txid, c, store, resource, operation)
+	if err != nil {
+		return err
+	}
+	record, err := loader(c)
+	if err != nil {
+		return authorizationError(txid, "load record", err)
+	}
+	allowed, err := EvaluateWrite(txid, resource, operation, record, user_claims, policies)
+	if err != nil {
+		return authorizationError(txid, "evaluate policies", err)
+	}
+	if !allowed {
+		log.Printf("%s | no policy allows %s on %s\n", txid.String(), operation, resource)
+		return ErrNotAuthorized
+	}
+	return nil
+}
+
+// auditAuthorization records the decision for impersonation tokens, so the
+// audit trail shows what the admin was allowed to do as the user. Any error
+// is recorded as a denial.
+func auditAuthorization(txid uuid.UUID, c *fiber.Ctx, resource string, operation string, err error, audit_logger AuditLogger) {
+	user_claims, ok := c.Locals("user_claims").(types.UserClaims)
+	if audit_logger == nil || !ok || user_claims.Actor == nil {
+		return
+	}
+	event := types.AuditEvent{
+		TransactionID: txid,
+		Action:        "impersonated_authorization",
+		UserID:        user_claims.UserID,
+		ActorID:       &user_claims.Actor.UserID,
+		Method:        c.Method(),
+		Path:          c.Path(),
+		Resource:      resource,
+		Operation:     operation,
+		Allowed:       err == nil,
+		OccurredOn:    time.Now().UTC(),
+	}
+	if err != nil {
+		event.Detail = err.Error()
+	}
+	audit_logger.Audit(event)
+}
+
+// AuthorizationFilter returns the SQL filter and args AuthorizeRead stored,
+// the filter denies everything when the route wasn't authorized.
+func AuthorizationFilter(c *fiber.Ctx) (string, []interface{}) {
+	filter, ok := c.Locals("authorization_filter").(string)
+	if !ok {
+		return "1=0", nil
+	}
+	args, _ := c.Locals("authorization_args").([]interface{})
+	return filter, args
+}
+
+func loadPolicies(txid uuid.UUID, c *fiber.Ctx, store PolicyStore, resource string, operation string) (types.UserClaims, []types.PermissionDTO, error) {
+	user_claims, ok := c.Locals("user_claims").(types.UserClaims)
+	if !ok {
+		// Machine clients aren't bound to policies, anonymous requests have no claims
+		if _, ok := c.Locals("client_claims").(types.ClientClaims); ok {
+			return types.UserClaims{}, nil, ErrNotAuthorized
+		}
+		return types.UserClaims{}, nil, security.ErrMissingCredentials
+	}
+	policies, err := store.GetPolicies(txid, user_claims, resource, operation)
+	if err != nil {
+		return types.UserClaims{}, nil, authorizationError(txid, "load policies", err)
+	}
+	if len(policies) == 0 {
+		log.Printf("%s | no policies for %s on %s\n", txid.String(), operation, resource)
+		return types.UserClaims{}, nil, ErrNotAuthorized
+	}
+	return user_claims, policies, nil
+}
+
+// authorizationError keeps platform and fiber errors, i.e. denials and bad
+// request bodies, as they are. Anything else is logged with the txid and
+// reported as a server error without its details.
+func authorizationError(txid uuid.UUID, step string, err error) error {
+	var platform_error *types.PlatformError
+	var fiber_error *fiber.Error
+	if errors.As(err, &platform_error) || errors.As(err, &fiber_error) {
+		log.Printf("%s | %s: %s\n", txid.String(), step, err.Error())
+		return err
+	}
+	log.Printf("%s | failed to %s: %s\n", txid.String(), step, err.Error())
+	return fiber.NewError(fiber.StatusInternalServerError, "failed to authorize")
+}
+
+func requestBodyRecord(c *fiber.Ctx) (map[string]interface{}, error) {
+	record := map[string]interface{}{}
+	err := c.BodyParser(&record)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	return record, nil
+}
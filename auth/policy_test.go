@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/thedanisaur/jfl_platform/types"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// testPolicyStore returns the same policies or error for every request.
+type testPolicyStore struct {
+	policies []types.PermissionDTO
+	err      error
+}
+
+func (store testPolicyStore) GetPolicies(txid uuid.UUID, user_claims types.UserClaims, resource string, operation string) ([]types.PermissionDTO, error) {
+	return store.policies, store.err
+}
+
+// testAuthorizeApp uses fiber's default error handler, the platform errors
+// have to carry their status without handler.ErrorHandler.
+func testAuthorizeApp(txid uuid.UUID, authorize fiber.Handler) *fiber.App {
+	app := fiber.New()
+	app.All("/*", func(c *fiber.Ctx) error {
+		c.Locals("transaction_id", txid)
+		c.Locals("user_claims", testUserClaims())
+		return c.Next()
+	}, authorize, func(c *fiber.Ctx) error {
+		filter, _ := AuthorizationFilter(c)
+		return c.SendString(filter)
+	})
+	return app
+}
+
+func testCaptureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+	return &buffer
+}
+
+func TestAuthorizeUnderDefaultErrorHandler(t *testing.T) {
+	store_error := errors.New("connection refused")
+	tests := []struct {
+		name      string
+		authorize func() fiber.Handler
+		body      string
+		status    int
+		logged    string
+	}{
+		{"read allowed", func() fiber.Handler {
+			return AuthorizeRead(testPolicyStore{policies: []types.PermissionDTO{testPolicy("true")}}, "logs", "read", nil, nil)
+		}, "{}", fiber.StatusOK, ""},
+		{"read without policies", func() fiber.Handler {
+			return AuthorizeRead(testPolicyStore{}, "logs", "read", nil, nil)
+		}, "{}", fiber.StatusForbidden, ""},
+		{"read store error", func() fiber.Handler {
+			return AuthorizeRead(testPolicyStore{err: store_error}, "logs", "read", nil, nil)
+		}, "{}", fiber.StatusInternalServerError, "failed to load policies: connection refused"},
+		{"write denied", func() fiber.Handler {
+			return AuthorizeWrite(testPolicyStore{policies: []types.PermissionDTO{testPolicy("false")}}, "logs", "update", nil, nil)
+		}, "{}", fiber.StatusForbidden, ""},
+		{"write store error", func() fiber.Handler {
+			return AuthorizeWrite(testPolicyStore{err: store_error}, "logs", "update", nil, nil)
+		}, "{}", fiber.StatusInternalServerError, "failed to load policies: connection refused"},
+		{"write loader error", func() fiber.Handler {
+			store := testPolicyStore{policies: []types.PermissionDTO{testPolicy("true")}}
+			return AuthorizeWrite(store, "logs", "update", func(c *fiber.Ctx) (map[string]interface{}, error) {
+				return nil, errors.New("record query failed")
+			}, nil)
+		}, "{}", fiber.StatusInternalServerError, "failed to load record: record query failed"},
+		{"write bad body", func() fiber.Handler {
+			return AuthorizeWrite(testPolicyStore{policies: []types.PermissionDTO{testPolicy("true")}}, "logs", "update", nil, nil)
+		}, "{", fiber.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := testCaptureLog(t)
+			txid := uuid.New()
+			app := testAuthorizeApp(txid, test.authorize())
+			request := httptest.NewRequest(fiber.MethodPost, "/logs", strings.NewReader(test.body))
+			request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			status, body := testSend(t, app, request)
+			if status != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, status, body)
+			}
+			if strings.Contains(body, "connection refused") || strings.Contains(body, "record query failed") {
+				t.Fatalf("the error details must not be sent, got %q", body)
+			}
+			if test.logged != "" && !strings.Contains(buffer.String(), txid.String()+" | "+test.logged) {
+				t.Fatalf("expected %q to be logged with the txid, got:\n%s", test.logged, buffer.String())
+			}
+		})
+	}
+}
+
+// testAuditLogger keeps the events for the test to inspect.
+type testAuditLogger struct {
+	events []types.AuditEvent
+}
+
+func (audit_logger *testAuditLogger) Audit(event types.AuditEvent) {
+	audit_logger.events = append(audit_logger.events, event)
+}
+
+func TestAuthorizeAuditsImpersonation(t *testing.T) {
+	store := testPolicyStore{policies: []types.PermissionDTO{testPolicy("true")}}
+	actor_id := uuid.New()
+	tests := []struct {
+		name      string
+		actor     *types.ActorClaims
+		authorize func(audit_logger AuditLogger) fiber.Handler
+		status    int
+		operation string
+		allowed   bool
+	}{
+		{"impersonated read", &types.ActorClaims{UserID: actor_id}, func(audit_logger AuditLogger) fiber.Handler {
+			return AuthorizeRead(store, "logs", "read", nil, audit_logger)
+		}, fiber.StatusOK, "read", true},
+		{"impersonated read only write", &types.ActorClaims{UserID: actor_id}, func(audit_logger AuditLogger) fiber.Handler {
+			return AuthorizeWrite(store, "logs", "update", nil, audit_logger)
+		}, fiber.StatusForbidden, "update", false},
+		{"impersonated write", &types.ActorClaims{UserID: actor_id, AllowWrite: true}, func(audit_logger AuditLogger) fiber.Handler {
+			return AuthorizeWrite(store, "logs", "update", nil, audit_logger)
+		}, fiber.StatusOK, "update", true},
+		{"own read", nil, func(audit_logger AuditLogger) fiber.Handler {
+			return AuthorizeRead(store, "logs", "read", nil, audit_logger)
+		}, fiber.StatusOK, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			audit_logger := &testAuditLogger{}
+			user_claims := testUserClaims()
+			user_claims.Actor = test.actor
+			app := fiber.New()
+			app.All("/*", func(c *fiber.Ctx) error {
+				c.Locals("user_claims", user_claims)
+				return c.Next()
+			}, test.authorize(audit_logger), func(c *fiber.Ctx) error {
+				return c.SendStatus(fiber.StatusOK)
+			})
+			request := httptest.NewRequest(fiber.MethodPost, "/logs", strings.NewReader("{}"))
+			request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			status, body := testSend(t, app, request)
+			if status != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, status, body)
+			}
+			if test.actor == nil {
+				if len(audit_logger.events) != 0 {
+					t.Fatalf("expected no audit events, got %v", audit_logger.events)
+				}
+				return
+			}
+			if len(audit_logger.events) != 1 {
+				t.Fatalf("expected one audit event, got %d", len(audit_logger.events))
+			}
+			event := audit_logger.events[0]
+			if event.Resource != "logs" || event.Operation != test.operation || event.Allowed != test.allowed {
+				t.Fatalf("unexpected audit event %+v", event)
+			}
+			if event.UserID != user_claims.UserID || event.ActorID == nil || *event.ActorID != actor_id {
+				t.Fatalf("expected the admin acting as the user, got %+v", event)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"log"
+	"strings"
+
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/AuthenticationMode"
+	"github.com/thedanisaur/jfl_platform/types/MutualTLSMode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// RouteRule matches requests by method and path. An empty Method matches any
+// method and GET also matches HEAD, which fiber registers alongside it. Path
+// segments match literally except `*` and `:param`, which match any single
+// segment, and a trailing `*`, which matches the rest of the path.
+//
+// Paths are compared the way fiber routes them: ignoring case unless the app
+// sets CaseSensitive, and unescaped only when the app sets UnescapePath.
+type RouteRule struct {
+	Method string
+	Path   string
+}
+
+// RouteAuthentication is a line of the startup report.
+type RouteAuthentication struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+	Mode   string `json:"mode"`
+}
+
+func (rule RouteRule) matches(method string, path string, case_sensitive bool) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, method) {
+		if !strings.EqualFold(rule.Method, fiber.MethodGet) || method != fiber.MethodHead {
+			return false
+		}
+	}
+	pattern_segments := strings.Split(strings.Trim(rule.Path, "/"), "/")
+	path_segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, pattern_segment := range pattern_segments {
+		if pattern_segment == "*" && i == len(pattern_segments)-1 {
+			return true
+		}
+		if i >= len(path_segments) {
+			return false
+		}
+		if pattern_segment == "*" || strings.HasPrefix(pattern_segment, ":") {
+			continue
+		}
+		if case_sensitive && pattern_segment != path_segments[i] {
+			return false
+		}
+		if !case_sensitive && !strings.EqualFold(pattern_segment, path_segments[i]) {
+			return false
+		}
+	}
+	return len(pattern_segments) == len(path_segments)
+}
+
+// routeMode resolves the mode of a request, public rules win over optional
+// ones and anything else requires authentication.
+func routeMode(method string, path string, case_sensitive bool, options AuthenticationOptions) string {
+	for _, rule := range options.PublicRoutes {
+		if rule.matches(method, path, case_sensitive) {
+			return AuthenticationMode.Public
+		}
+	}
+	for _, rule := range options.OptionalRoutes {
+		if rule.matches(method, path, case_sensitive) {
+			return AuthenticationMode.Optional
+		}
+	}
+	return AuthenticationMode.Required
+}
+
+// hasCredentials reports whether the request tried to authenticate at all,
+// credentials that are sent but invalid are still rejected on optional routes.
+func hasCredentials(c *fiber.Ctx, config types.Config, options AuthenticationOptions) bool {
+	if c.Get(fiber.HeaderAuthorization) != "" || security.SessionCookieToken(c, config) != "" {
+		return true
+	}
+	if options.APIKeyStore != nil && c.Get(security.HeaderAPIKey) != "" {
+		return true
+	}
+	if config.App.MutualTLS.Mode != MutualTLSMode.Disabled {
+		connection_state := c.Context().TLSConnectionState()
+		return connection_state != nil && len(connection_state.PeerCertificates) > 0
+	}
+	return false
+}
+
+// skipAuthentication is true for public routes and for anonymous requests to
+// optional routes.
+func skipAuthentication(txid uuid.UUID, c *fiber.Ctx, config types.Config, options AuthenticationOptions) bool {
+	mode := routeMode(c.Method(), c.Path(), c.App().Config().CaseSensitive, options)
+	if mode == AuthenticationMode.Required {
+		return false
+	}
+	if mode == AuthenticationMode.Optional && hasCredentials(c, config, options) {
+		return false
+	}
+	log.Printf("%s | %s route, continuing without authentication\n", txid.String(), mode)
+	return true
+}
+
+// ReportRouteAuthentication logs the authentication mode of every route
+// registered on the app, call it once the routes are registered and before
+// Listen. It assumes the middleware is mounted on the whole app.
+func ReportRouteAuthentication(app *fiber.App, options AuthenticationOptions) []RouteAuthentication {
+	txid := uuid.New()
+	report := []RouteAuthentication{}
+	for _, route := range app.GetRoutes(true) {
+		route_authentication := RouteAuthentication{
+			Method: route.Method,
+			Path:   route.Path,
+			Name:   route.Name,
+			Mode:   routeMode(route.Method, route.Path, app.Config().CaseSensitive, options),
+		}
+		log.Printf("%s | %s | method: %s | path: %s | name: %s\n", txid.String(), route_authentication.Mode, route.Method, route.Path, route.Name)
+		report = append(report, route_authentication)
+	}
+	return report
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/thedanisaur/jfl_platform/handler"
+	"github.com/thedanisaur/jfl_platform/types/AuthenticationMode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRouteRuleMatches(t *testing.T) {
+	tests := []struct {
+		name           string
+		rule           RouteRule
+		method         string
+		path           string
+		case_sensitive bool
+		matches        bool
+	}{
+		{"literal", RouteRule{Path: "/health"}, fiber.MethodGet, "/health", false, true},
+		{"trailing slash", RouteRule{Path: "/health"}, fiber.MethodGet, "/health/", false, true},
+		{"other case", RouteRule{Path: "/health"}, fiber.MethodGet, "/Health", false, true},
+		{"other case when case sensitive", RouteRule{Path: "/health"}, fiber.MethodGet, "/Health", true, false},
+		{"method", RouteRule{Method: fiber.MethodPost, Path: "/login"}, fiber.MethodGet, "/login", false, false},
+		{"head matches get", RouteRule{Method: fiber.MethodGet, Path: "/health"}, fiber.MethodHead, "/health", false, true},
+		{"param", RouteRule{Path: "/users/:id/avatar"}, fiber.MethodGet, "/users/42/avatar", false, true},
+		{"param is a single segment", RouteRule{Path: "/users/:id"}, fiber.MethodGet, "/users/42/avatar", false, false},
+		{"trailing wildcard", RouteRule{Path: "/docs/*"}, fiber.MethodGet, "/docs/api/v1", false, true},
+		{"longer path", RouteRule{Path: "/docs"}, fiber.MethodGet, "/docs/api", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.rule.matches(test.method, test.path, test.case_sensitive) != test.matches {
+				t.Fatalf("expected %s %s to match %v: %v", test.method, test.path, test.rule, test.matches)
+			}
+		})
+	}
+}
+
+func TestPublicRouteFollowsCaseSensitivity(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	options := AuthenticationOptions{
+		PublicRoutes: []RouteRule{{Method: fiber.MethodGet, Path: "/health"}},
+	}
+	newApp := func(case_sensitive bool) *fiber.App {
+		app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler, CaseSensitive: case_sensitive})
+		app.Use(AuthenticationMiddleware(config, key_ring, options))
+		app.Get("/health", func(c *fiber.Ctx) error {
+			return c.SendString("ok")
+		})
+		return app
+	}
+
+	// fiber routes /Health to /health by default, so the rule has to match it too
+	status, body := testSend(t, newApp(false), httptest.NewRequest(fiber.MethodGet, "/Health", nil))
+	if status != fiber.StatusOK {
+		t.Fatalf("expected the public route to be skipped, got %d: %s", status, body)
+	}
+	status, _ = testSend(t, newApp(true), httptest.NewRequest(fiber.MethodGet, "/Health", nil))
+	if status != fiber.StatusUnauthorized {
+		t.Fatalf("expected authentication on a case sensitive app, got %d", status)
+	}
+
+	report := ReportRouteAuthentication(newApp(false), options)
+	for _, route := range report {
+		if route.Path == "/health" && route.Mode != AuthenticationMode.Public {
+			t.Fatalf("expected %s %s to be reported public, got %s", route.Method, route.Path, route.Mode)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/password"
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/AuthenticationMethod"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+	"github.com/thedanisaur/jfl_platform/util"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// ErrorCodeStepUpRequired is the RFC 9470 error returned when the user has to
+// re-authenticate before the request is allowed.
+const ErrorCodeStepUpRequired = "insufficient_user_authentication"
+
+var ErrStepUpRequired = types.NewPlatformError(ErrorKind.Unauthenticated, ErrorCodeStepUpRequired, "re-authentication required")
+
+type StepUpOptions struct {
+	// MaxAge is how long ago the user may have authenticated, zero doesn't limit it
+	MaxAge time.Duration
+	// RequireMFA requires the user to have authenticated with a second factor
+	RequireMFA bool
+}
+
+// ReauthenticationLookup loads the authenticated user to check their password again.
+type ReauthenticationLookup interface {
+	GetUserByID(txid uuid.UUID, user_id uuid.UUID) (types.UserResponse, error)
+}
+
+// RequireStepUp guards high assurance routes, i.e. signing a flight log. Mount
+// it after AuthenticationMiddleware, requests that don't meet the options get
+// a 401 challenge and the client should send the user to ReauthenticationHandler.
+// API keys and impersonation tokens can never step up.
+func RequireStepUp(options StepUpOptions) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		txid, _ := c.Locals("transaction_id").(uuid.UUID)
+		user_claims, ok := c.Locals("user_claims").(types.UserClaims)
+		if !ok || user_claims.APIKeyID != "" || user_claims.Actor != nil {
+			return ErrNotAuthorized
+		}
+		if isSteppedUp(user_claims, options) {
+			return c.Next()
+		}
+		log.Printf("%s | user %s must re-authenticate\n", txid.String(), user_claims.UserID.String())
+		challenge := []string{fmt.Sprintf(`Bearer error="%s"`, ErrorCodeStepUpRequired)}
+		if options.MaxAge > 0 {
+			challenge = append(challenge, fmt.Sprintf(`max_age=%d`, int(options.MaxAge.Seconds())))
+		}
+		if options.RequireMFA {
+			challenge = append(challenge, fmt.Sprintf(`acr_values="%s"`, AuthenticationMethod.MultiFactor))
+		}
+		c.Set(fiber.HeaderWWWAuthenticate, strings.Join(challenge, ", "))
+		return ErrStepUpRequired
+	}
+}
+
+func isSteppedUp(user_claims types.UserClaims, options StepUpOptions) bool {
+	if options.MaxAge > 0 {
+		if user_claims.AuthenticatedAt.IsZero() || time.Since(user_claims.AuthenticatedAt) > options.MaxAge {
+			return false
+		}
+	}
+	if options.RequireMFA {
+		for _, method := range user_claims.AuthenticationMethods {
+			if method == AuthenticationMethod.MultiFactor {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ReauthenticationHandler checks the password, and the second factor when the
+// user is enrolled, of the already authenticated user and responds with a new
+// access token for the same session with auth_time moved forward. Mount it
+// behind AuthenticationMiddleware.
+func ReauthenticationHandler(config types.Config, key_ring *security.KeyRing, users ReauthenticationLookup, options LoginOptions) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		txid := transactionID(c)
+		log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(ReauthenticationHandler))
+
+		user_claims, ok := c.Locals("user_claims").(types.UserClaims)
+		if !ok {
+			return fiber.NewError(fiber.StatusUnauthorized, "not authenticated")
+		}
+		if user_claims.APIKeyID != "" || user_claims.Actor != nil {
+			return fiber.NewError(fiber.StatusForbidden, "can't re-authenticate")
+		}
+		var request types.ReauthenticationRequest
+		err := c.BodyParser(&request)
+		if err != nil || request.Password == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "password is required")
+		}
+
+		user, err := users.GetUserByID(txid, user_claims.UserID)
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to re-authenticate")
+		}
+		err = checkLockout(txid, c, lockoutKey(user.ID), options.AttemptStore)
+		if err != nil {
+			return err
+		}
+		match, _, err := password.Verify(request.Password, user.PasswordHash, config)
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+		}
+		if !match {
+			recordFailedLogin(txid, lockoutKey(user.ID), config, options.AttemptStore)
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid credentials")
+		}
+		authentication_methods, err := verifySecondFactor(txid, c, user.ID, config, options)
+		if err != nil {
+			return err
+		}
+		resetLockout(txid, user.ID, options.AttemptStore)
+
+		user_claims.AuthenticationMethods = authentication_methods
+		user_claims.AuthenticatedAt = time.Now().UTC()
+		response := types.TokenResponse{
+			TokenType: "Bearer",
+			ExpiresIn: config.App.LoginExpirationMs / 1000,
+		}
+		response.AccessToken, err = security.GenerateJWT(txid, user_claims, config, key_ring)
+		if err != nil {
+			log.Printf("%s | failed to generate token: %s\n", txid.String(), err.Error())
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to re-authenticate")
+		}
+		// The session stays the same but its CSRF token is replaced like at login
+		if config.App.Cookie.Enabled {
+			err = useCookieSession(txid, c, user_claims, &response, config, options)
+			if err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "failed to re-authenticate")
+			}
+		}
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return c.JSON(response)
+	}
+}
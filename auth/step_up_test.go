@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/thedanisaur/jfl_platform/handler"
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types/CSRFMode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestReauthenticationSharesLockoutAndRenewsCSRF(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testPasswordConfig()
+	config.App.Cookie.Enabled = true
+	config.App.Cookie.CSRFMode = CSRFMode.Synchronizer
+	config.App.Lockout.MaxAttempts = 2
+	config.App.Lockout.DurationMs = 60000
+	users, user := newTestUsers(t, config)
+	csrf_token_store := security.NewMemoryCSRFTokenStore()
+	options := LoginOptions{
+		AttemptStore:   security.NewMemoryLoginAttemptStore(),
+		CSRFTokenStore: csrf_token_store,
+	}
+
+	app := fiber.New(fiber.Config{ErrorHandler: handler.ErrorHandler})
+	app.Post("/login", LoginHandler(config, key_ring, users, options))
+	app.Post("/reauthenticate", AuthenticationMiddleware(config, key_ring, AuthenticationOptions{CSRFTokenStore: csrf_token_store}), ReauthenticationHandler(config, key_ring, users, options))
+
+	response, err := app.Test(testLoginRequest(user.Email, test_password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", response.StatusCode)
+	}
+	session_cookie := responseCookie(response, "jfl_session")
+	csrf_token := response.Header.Get(security.HeaderCSRFToken)
+	reauthenticate := func(passwd string, csrf_token string) *http.Response {
+		request := httptest.NewRequest(fiber.MethodPost, "/reauthenticate", strings.NewReader(`{"password": "`+passwd+`"}`))
+		request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		request.Header.Set(security.HeaderCSRFToken, csrf_token)
+		request.AddCookie(&http.Cookie{Name: session_cookie.Name, Value: session_cookie.Value})
+		response, err := app.Test(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	response = reauthenticate(test_password, csrf_token)
+	if response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", response.StatusCode)
+	}
+	renewed_csrf_token := response.Header.Get(security.HeaderCSRFToken)
+	if renewed_csrf_token == "" || renewed_csrf_token == csrf_token {
+		t.Fatal("re-authentication must issue a new csrf token")
+	}
+	response = reauthenticate(test_password, csrf_token)
+	if response.StatusCode != fiber.StatusForbidden {
+		t.Fatalf("the replaced csrf token must be rejected, got %d", response.StatusCode)
+	}
+
+	// Failed re-authentication counts towards the same lockout as login
+	for i := 0; i < config.App.Lockout.MaxAttempts; i++ {
+		reauthenticate("wrong", renewed_csrf_token)
+	}
+	response, err = app.Test(testLoginRequest(user.Email, test_password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("expected login to be locked, got %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+	"github.com/thedanisaur/jfl_platform/types/UserStatus"
+
+	"github.com/google/uuid"
+)
+
+// ErrorCodeUserNotApproved is the code of ErrUserNotApproved, returned when a
+// valid token belongs to a user that is suspended, deactivated, denied, retired
+// or pending.
+const ErrorCodeUserNotApproved = "user_not_approved"
+
+var ErrUserNotApproved = types.NewPlatformError(ErrorKind.Forbidden, ErrorCodeUserNotApproved, "user is not approved")
+
+// CachedUserStatusLookup caches another UserStatusLookup by user id. Keep the
+// ttl to a few seconds so suspending a user takes effect quickly, and call
+// Invalidate when a status changes for it to take effect immediately.
+type CachedUserStatusLookup struct {
+	lookup UserStatusLookup
+	cache  *ttlCache
+}
+
+func NewCachedUserStatusLookup(lookup UserStatusLookup, ttl time.Duration) *CachedUserStatusLookup {
+	return &CachedUserStatusLookup{
+		lookup: lookup,
+		cache:  newTTLCache(ttl),
+	}
+}
+
+func (cached_lookup *CachedUserStatusLookup) GetUserStatus(txid uuid.UUID, user_id uuid.UUID) (string, error) {
+	if value, ok := cached_lookup.cache.get(user_id); ok {
+		return value.(string), nil
+	}
+	status, err := cached_lookup.lookup.GetUserStatus(txid, user_id)
+	if err != nil {
+		return "", err
+	}
+	cached_lookup.cache.set(user_id, status)
+	return status, nil
+}
+
+func (cached_lookup *CachedUserStatusLookup) Invalidate(user_id uuid.UUID) {
+	cached_lookup.cache.invalidate(user_id)
+}
+
+func (cached_lookup *CachedUserStatusLookup) InvalidateAll() {
+	cached_lookup.cache.invalidateAll()
+}
+
+// checkUserStatus returns ErrUserNotApproved unless the user is approved. No
+// lookup means the check is skipped.
+func checkUserStatus(txid uuid.UUID, user_id uuid.UUID, lookup UserStatusLookup) error {
+	if lookup == nil {
+		return nil
+	}
+	status, err := lookup.GetUserStatus(txid, user_id)
+	if errors.Is(err, ErrUserNotFound) {
+		log.Printf("%s | user %s no longer exists\n", txid.String(), user_id.String())
+		return ErrUserNotApproved
+	}
+	if err != nil {
+		log.Printf("%s | failed to load user status: %s\n", txid.String(), err.Error())
+		return err
+	}
+	if status != UserStatus.Approved {
+		log.Printf("%s | user %s is %s\n", txid.String(), user_id.String(), status)
+		return ErrUserNotApproved
+	}
+	return nil
+}
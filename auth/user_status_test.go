@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/UserStatus"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// testStatuses is a UserStatusLookup, users that aren't listed don't exist.
+type testStatuses map[uuid.UUID]string
+
+func (statuses testStatuses) GetUserStatus(txid uuid.UUID, user_id uuid.UUID) (string, error) {
+	status, ok := statuses[user_id]
+	if !ok {
+		return "", ErrUserNotFound
+	}
+	return status, nil
+}
+
+func TestUserStatusChecksTheActor(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	user_claims := testUserClaims()
+	admin_id := uuid.New()
+	statuses := testStatuses{user_claims.UserID: UserStatus.Approved, admin_id: UserStatus.Approved}
+	app := testApp(AuthenticationMiddleware(config, key_ring, AuthenticationOptions{UserStatus: statuses}))
+	token := testUserToken(t, user_claims, config, key_ring)
+	user_claims.Actor = &types.ActorClaims{UserID: admin_id, RoleName: "admin"}
+	impersonation_token := testUserToken(t, user_claims, config, key_ring)
+
+	send := func(token string) int {
+		request := httptest.NewRequest(fiber.MethodGet, "/", nil)
+		request.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+		status, _ := testSend(t, app, request)
+		return status
+	}
+	if status := send(impersonation_token); status != fiber.StatusOK {
+		t.Fatalf("expected 200 while both are approved, got %d", status)
+	}
+
+	statuses[admin_id] = UserStatus.Suspended
+	if status := send(impersonation_token); status != fiber.StatusForbidden {
+		t.Fatalf("expected 403 once the admin is suspended, got %d", status)
+	}
+	if status := send(token); status != fiber.StatusOK {
+		t.Fatalf("the user's own token must still work, got %d", status)
+	}
+
+	delete(statuses, admin_id)
+	if status := send(impersonation_token); status != fiber.StatusForbidden {
+		t.Fatalf("expected 403 once the admin is deleted, got %d", status)
+	}
+
+	statuses[user_claims.UserID] = UserStatus.Suspended
+	if status := send(token); status != fiber.StatusForbidden {
+		t.Fatalf("expected 403 once the user is suspended, got %d", status)
+	}
+}
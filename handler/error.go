@@ -1,28 +1,100 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/google/uuid"
 )
 
+const MIMEApplicationProblemJSON = "application/problem+json"
+
+// Problem types of platform errors are their code under this namespace,
+// everything else is about:blank and described by the status alone.
+const problem_type_prefix = "urn:jfl:error:"
+const problem_type_blank = "about:blank"
+
+// ErrorHandler responds with application/problem+json to clients that ask for
+// it and with {"error": msg, "transaction_id": ...} to everyone else.
 // TODO [drd] make sure the services implement this for the standard
 func ErrorHandler(c *fiber.Ctx, err error) error {
-	code := fiber.StatusInternalServerError
-	msg := "internal server error"
+	problem := types.ProblemDetails{
+		Type:   problem_type_blank,
+		Status: fiber.StatusInternalServerError,
+		Detail: "internal server error",
+	}
+	transaction_id, ok := c.Locals("transaction_id").(uuid.UUID)
+	if ok {
+		problem.Instance = transaction_id.String()
+	}
 
-	if fiber_error, ok := err.(*fiber.Error); ok {
-		code = fiber_error.Code
-		msg = fiber_error.Message
+	// Platform errors convert to *fiber.Error as well, so they're checked first
+	var platform_error *types.PlatformError
+	var fiber_error *fiber.Error
+	if errors.As(err, &platform_error) {
+		problem.Type = problem_type_prefix + platform_error.Code
+		problem.Status = platform_error.StatusCode()
+		problem.Detail = platform_error.Message
+		problem.Code = platform_error.Code
+		problem.Errors = platform_error.Fields
+		if problem.Status == fiber.StatusUnauthorized {
+			setChallenge(c, platform_error)
+		}
+	} else if errors.As(err, &fiber_error) {
+		problem.Status = fiber_error.Code
+		problem.Detail = fiber_error.Message
+	} else {
+		// Only the transaction id reaches the client, the cause stays in the logs
+		log.Printf("%s | %s\n", problem.Instance, err.Error())
 	}
+	problem.Title = utils.StatusMessage(problem.Status)
 
-	response := fiber.Map{
-		"error": msg,
+	c.Status(problem.Status)
+	c.Vary(fiber.HeaderAccept)
+	// Older clients don't send problem+json and keep getting the original shape
+	if c.Accepts(fiber.MIMEApplicationJSON, MIMEApplicationProblemJSON) != MIMEApplicationProblemJSON {
+		return c.JSON(legacyError(problem))
+	}
+	err = c.JSON(problem)
+	if err != nil {
+		return err
 	}
+	c.Set(fiber.HeaderContentType, MIMEApplicationProblemJSON)
+	return nil
+}
 
-	transaction_id, ok := c.Locals("transaction_id").(uuid.UUID)
-	if ok {
-		response["transaction_id"] = transaction_id.String()
+func legacyError(problem types.ProblemDetails) fiber.Map {
+	response := fiber.Map{
+		"error": problem.Detail,
+	}
+	if problem.Code != "" {
+		response["code"] = problem.Code
 	}
+	if len(problem.Errors) > 0 {
+		response["fields"] = problem.Errors
+	}
+	if problem.Instance != "" {
+		response["transaction_id"] = problem.Instance
+	}
+	return response
+}
 
-	return c.Status(code).JSON(response)
+// setChallenge adds the RFC 6750 challenge to a 401 unless the middleware
+// already set a more specific one, i.e. for step up. A request without
+// credentials only gets the scheme.
+func setChallenge(c *fiber.Ctx, platform_error *types.PlatformError) {
+	if len(c.Response().Header.Peek(fiber.HeaderWWWAuthenticate)) > 0 {
+		return
+	}
+	if errors.Is(platform_error, security.ErrMissingCredentials) {
+		c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+		return
+	}
+	c.Set(fiber.HeaderWWWAuthenticate, fmt.Sprintf(`Bearer error="invalid_token", error_description="%s"`, platform_error.Message))
 }
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/thedanisaur/jfl_platform/security"
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func testError(t *testing.T, error_handler fiber.ErrorHandler, err error, accept string) (int, string, map[string]interface{}) {
+	t.Helper()
+	config := fiber.Config{}
+	if error_handler != nil {
+		config.ErrorHandler = error_handler
+	}
+	app := fiber.New(config)
+	app.Get("/", func(c *fiber.Ctx) error {
+		return err
+	})
+	request := httptest.NewRequest(fiber.MethodGet, "/", nil)
+	if accept != "" {
+		request.Header.Set(fiber.HeaderAccept, accept)
+	}
+	response, test_err := app.Test(request)
+	if test_err != nil {
+		t.Fatal(test_err)
+	}
+	body, test_err := io.ReadAll(response.Body)
+	if test_err != nil {
+		t.Fatal(test_err)
+	}
+	decoded := map[string]interface{}{}
+	_ = json.Unmarshal(body, &decoded)
+	return response.StatusCode, response.Header.Get(fiber.HeaderWWWAuthenticate), decoded
+}
+
+func TestPlatformErrorStatusUnderDefaultErrorHandler(t *testing.T) {
+	tests := []struct {
+		kind   string
+		status int
+	}{
+		{ErrorKind.Unauthenticated, fiber.StatusUnauthorized},
+		{ErrorKind.TokenExpired, fiber.StatusUnauthorized},
+		{ErrorKind.Forbidden, fiber.StatusForbidden},
+		{ErrorKind.Validation, fiber.StatusBadRequest},
+		{ErrorKind.NotFound, fiber.StatusNotFound},
+		{ErrorKind.Conflict, fiber.StatusConflict},
+		{"unknown", fiber.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.kind, func(t *testing.T) {
+			err := types.NewPlatformError(test.kind, "code", "message").Wrap(errors.New("cause"))
+			status, _, _ := testError(t, nil, err, "")
+			if status != test.status {
+				t.Fatalf("default handler: expected %d, got %d", test.status, status)
+			}
+			status, _, _ = testError(t, ErrorHandler, err, "")
+			if status != test.status {
+				t.Fatalf("ErrorHandler: expected %d, got %d", test.status, status)
+			}
+		})
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	status, challenge, body := testError(t, ErrorHandler, security.ErrMissingCredentials, "")
+	if status != fiber.StatusUnauthorized || challenge != "Bearer" {
+		t.Fatalf("missing credentials: unexpected %d %q", status, challenge)
+	}
+	if body["code"] != security.ErrMissingCredentials.Code || body["error"] == nil {
+		t.Fatalf("missing credentials: unexpected legacy body %v", body)
+	}
+
+	status, challenge, _ = testError(t, ErrorHandler, security.ErrInvalidToken.Wrap(errors.New("bad signature")), "")
+	if status != fiber.StatusUnauthorized || challenge != `Bearer error="invalid_token", error_description="`+security.ErrInvalidToken.Message+`"` {
+		t.Fatalf("invalid token: unexpected %d %q", status, challenge)
+	}
+
+	fields := []types.FieldError{{Field: "password", Message: "too short"}}
+	status, _, body = testError(t, ErrorHandler, types.NewPlatformError(ErrorKind.Validation, "weak_password", "weak password").WithFields(fields...), MIMEApplicationProblemJSON)
+	if status != fiber.StatusBadRequest {
+		t.Fatalf("validation: expected 400, got %d", status)
+	}
+	if body["type"] != problem_type_prefix+"weak_password" || body["status"] != float64(fiber.StatusBadRequest) || body["errors"] == nil {
+		t.Fatalf("validation: unexpected problem %v", body)
+	}
+
+	// Fiber errors keep their status when wrapped
+	status, _, body = testError(t, ErrorHandler, fmt.Errorf("loading the flight: %w", fiber.NewError(fiber.StatusNotFound, "flight not found")), MIMEApplicationProblemJSON)
+	if status != fiber.StatusNotFound || body["detail"] != "flight not found" || body["type"] != problem_type_blank {
+		t.Fatalf("wrapped fiber error: unexpected %d %v", status, body)
+	}
+
+	// The cause of other errors stays in the logs
+	status, _, body = testError(t, ErrorHandler, errors.New("database password is hunter2"), MIMEApplicationProblemJSON)
+	if status != fiber.StatusInternalServerError || body["detail"] != "internal server error" || body["type"] != problem_type_blank {
+		t.Fatalf("server error: unexpected %d %v", status, body)
+	}
+}
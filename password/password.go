@@ -0,0 +1,203 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/PasswordAlgorithm"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidHash = errors.New("invalid password hash")
+var ErrUnsupportedAlgorithm = errors.New("unsupported password algorithm")
+
+// Defaults follow the OWASP recommendations and are used for any cost
+// parameter left unset in the config.
+const default_memory_kib = 64 * 1024
+const default_iterations = 3
+const default_parallelism = 2
+const default_salt_length = 16
+const default_key_length = 32
+const default_bcrypt_cost = 12
+
+type argon2Parameters struct {
+	memory_kib  uint32
+	iterations  uint32
+	parallelism uint8
+	salt_length uint32
+	key_length  uint32
+}
+
+func configuredAlgorithm(config types.Config) string {
+	if config.App.Password.Algorithm == "" {
+		return PasswordAlgorithm.Argon2id
+	}
+	return config.App.Password.Algorithm
+}
+
+func configuredArgon2Parameters(config types.Config) argon2Parameters {
+	parameters := argon2Parameters{
+		memory_kib:  config.App.Password.Argon2id.MemoryKiB,
+		iterations:  config.App.Password.Argon2id.Iterations,
+		parallelism: config.App.Password.Argon2id.Parallelism,
+		salt_length: config.App.Password.Argon2id.SaltLength,
+		key_length:  config.App.Password.Argon2id.KeyLength,
+	}
+	if parameters.memory_kib == 0 {
+		parameters.memory_kib = default_memory_kib
+	}
+	if parameters.iterations == 0 {
+		parameters.iterations = default_iterations
+	}
+	if parameters.parallelism == 0 {
+		parameters.parallelism = default_parallelism
+	}
+	if parameters.salt_length == 0 {
+		parameters.salt_length = default_salt_length
+	}
+	if parameters.key_length == 0 {
+		parameters.key_length = default_key_length
+	}
+	return parameters
+}
+
+func configuredBcryptCost(config types.Config) int {
+	if config.App.Password.BcryptCost == 0 {
+		return default_bcrypt_cost
+	}
+	return config.App.Password.BcryptCost
+}
+
+// Hash hashes the password with the configured algorithm. argon2id hashes are
+// encoded in the PHC string format:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func Hash(password string, config types.Config) (string, error) {
+	switch configuredAlgorithm(config) {
+	case PasswordAlgorithm.Argon2id:
+		return hashArgon2id(password, configuredArgon2Parameters(config))
+	case PasswordAlgorithm.Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), configuredBcryptCost(config))
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+	return "", ErrUnsupportedAlgorithm
+}
+
+// Verify checks the password against the stored hash in constant time. When
+// the password matches but the hash was made with a different algorithm or
+// weaker parameters than configured, needs_rehash is set so the caller can
+// store Hash(password) while it still has the plain text, i.e. at login.
+func Verify(password string, encoded_hash string, config types.Config) (bool, bool, error) {
+	var match bool
+	switch {
+	case strings.HasPrefix(encoded_hash, "$argon2id$"):
+		parameters, salt, key, err := decodeArgon2id(encoded_hash)
+		if err != nil {
+			return false, false, err
+		}
+		other_key := argon2.IDKey([]byte(password), salt, parameters.iterations, parameters.memory_kib, parameters.parallelism, uint32(len(key)))
+		match = subtle.ConstantTimeCompare(key, other_key) == 1
+	case isBcrypt(encoded_hash):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded_hash), []byte(password))
+		if err != nil && !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, ErrInvalidHash
+		}
+		match = err == nil
+	default:
+		return false, false, ErrUnsupportedAlgorithm
+	}
+	if !match {
+		return false, false, nil
+	}
+	return true, NeedsRehash(encoded_hash, config), nil
+}
+
+// NeedsRehash reports whether the hash is weaker than, or uses a different
+// algorithm from, what is currently configured.
+func NeedsRehash(encoded_hash string, config types.Config) bool {
+	switch configuredAlgorithm(config) {
+	case PasswordAlgorithm.Argon2id:
+		parameters, salt, key, err := decodeArgon2id(encoded_hash)
+		if err != nil {
+			return true
+		}
+		configured := configuredArgon2Parameters(config)
+		return parameters.memory_kib < configured.memory_kib ||
+			parameters.iterations < configured.iterations ||
+			parameters.parallelism < configured.parallelism ||
+			uint32(len(salt)) < configured.salt_length ||
+			uint32(len(key)) < configured.key_length
+	case PasswordAlgorithm.Bcrypt:
+		if !isBcrypt(encoded_hash) {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(encoded_hash))
+		if err != nil {
+			return true
+		}
+		return cost < configuredBcryptCost(config)
+	}
+	return false
+}
+
+func hashArgon2id(password string, parameters argon2Parameters) (string, error) {
+	salt := make([]byte, parameters.salt_length)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, parameters.iterations, parameters.memory_kib, parameters.parallelism, parameters.key_length)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		parameters.memory_kib,
+		parameters.iterations,
+		parameters.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func decodeArgon2id(encoded_hash string) (argon2Parameters, []byte, []byte, error) {
+	parameters := argon2Parameters{}
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+	parts := strings.Split(encoded_hash, "$")
+	if len(parts) != 6 || parts[1] != PasswordAlgorithm.Argon2id {
+		return parameters, nil, nil, ErrInvalidHash
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return parameters, nil, nil, ErrInvalidHash
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parameters.memory_kib, &parameters.iterations, &parameters.parallelism)
+	if err != nil {
+		return parameters, nil, nil, ErrInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return parameters, nil, nil, ErrInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return parameters, nil, nil, ErrInvalidHash
+	}
+	parameters.salt_length = uint32(len(salt))
+	parameters.key_length = uint32(len(key))
+	return parameters, salt, key, nil
+}
+
+func isBcrypt(encoded_hash string) bool {
+	return strings.HasPrefix(encoded_hash, "$2a$") ||
+		strings.HasPrefix(encoded_hash, "$2b$") ||
+		strings.HasPrefix(encoded_hash, "$2y$")
+}
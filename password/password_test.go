@@ -0,0 +1,154 @@
+package password
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/PasswordAlgorithm"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const test_password = "correct horse battery staple"
+
+// testConfig keeps argon2id and bcrypt cheap enough for tests.
+func testConfig() types.Config {
+	config := types.Config{}
+	config.App.Password.Argon2id.MemoryKiB = 1024
+	config.App.Password.Argon2id.Iterations = 1
+	config.App.Password.Argon2id.Parallelism = 1
+	config.App.Password.BcryptCost = bcrypt.MinCost
+	return config
+}
+
+func testBcryptHash(t *testing.T, cost int) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(test_password), cost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestHashEncodesPHC(t *testing.T) {
+	config := testConfig()
+	hash, err := Hash(test_password, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) || parts[3] != "m=1024,t=1,p=1" {
+		t.Fatalf("unexpected PHC string %q", hash)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) != default_salt_length {
+		t.Fatalf("expected a %d byte salt, got %q", default_salt_length, parts[4])
+	}
+	// The key is argon2id of the password with the encoded parameters
+	key := argon2.IDKey([]byte(test_password), salt, 1, 1024, 1, default_key_length)
+	if parts[5] != base64.RawStdEncoding.EncodeToString(key) {
+		t.Fatal("the encoded key doesn't match argon2id")
+	}
+
+	other_hash, err := Hash(test_password, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other_hash == hash {
+		t.Fatal("every hash needs its own salt")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	config := testConfig()
+	argon2_hash, err := Hash(test_password, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		password string
+		hash     string
+		match    bool
+		err      error
+	}{
+		{"argon2id", test_password, argon2_hash, true, nil},
+		{"argon2id wrong password", "wrong", argon2_hash, false, nil},
+		{"bcrypt", test_password, testBcryptHash(t, bcrypt.MinCost), true, nil},
+		{"bcrypt wrong password", "wrong", testBcryptHash(t, bcrypt.MinCost), false, nil},
+		{"bcrypt truncated", test_password, testBcryptHash(t, bcrypt.MinCost)[:20], false, ErrInvalidHash},
+		{"wrong part count", test_password, "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA", false, ErrInvalidHash},
+		{"other version", test_password, strings.Replace(argon2_hash, "v=19", "v=16", 1), false, ErrInvalidHash},
+		{"bad parameters", test_password, strings.Replace(argon2_hash, "m=1024,t=1,p=1", "m=1024;t=1;p=1", 1), false, ErrInvalidHash},
+		{"bad salt", test_password, "$argon2id$v=19$m=1024,t=1,p=1$!!!$c2FsdA", false, ErrInvalidHash},
+		{"empty key", test_password, "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$", false, ErrInvalidHash},
+		{"argon2i", test_password, strings.Replace(argon2_hash, "argon2id", "argon2i", 1), false, ErrUnsupportedAlgorithm},
+		{"plain text", test_password, test_password, false, ErrUnsupportedAlgorithm},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match, _, err := Verify(test.password, test.hash, config)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+			if match != test.match {
+				t.Fatalf("expected match %v, got %v", test.match, match)
+			}
+		})
+	}
+}
+
+func TestVerifyNeedsRehash(t *testing.T) {
+	config := testConfig()
+	argon2_hash, err := Hash(test_password, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stronger_config := testConfig()
+	stronger_config.App.Password.Argon2id.Iterations = 2
+	stronger_hash, err := Hash(test_password, stronger_config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcrypt_config := testConfig()
+	bcrypt_config.App.Password.Algorithm = PasswordAlgorithm.Bcrypt
+	bcrypt_config.App.Password.BcryptCost = bcrypt.MinCost + 1
+
+	tests := []struct {
+		name         string
+		hash         string
+		config       types.Config
+		needs_rehash bool
+	}{
+		{"current argon2id", argon2_hash, config, false},
+		{"weaker argon2id", argon2_hash, stronger_config, true},
+		{"stronger argon2id", stronger_hash, config, false},
+		{"bcrypt migrates to argon2id", testBcryptHash(t, bcrypt.MinCost+1), config, true},
+		{"current bcrypt", testBcryptHash(t, bcrypt.MinCost+1), bcrypt_config, false},
+		{"weaker bcrypt", testBcryptHash(t, bcrypt.MinCost), bcrypt_config, true},
+		{"argon2id migrates to bcrypt", argon2_hash, bcrypt_config, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match, needs_rehash, err := Verify(test_password, test.hash, test.config)
+			if err != nil || !match {
+				t.Fatalf("expected a match, got %v %v", match, err)
+			}
+			if needs_rehash != test.needs_rehash {
+				t.Fatalf("expected needs_rehash %v, got %v", test.needs_rehash, needs_rehash)
+			}
+		})
+	}
+
+	// A wrong password never asks for a rehash, the caller doesn't have the
+	// plain text to hash
+	_, needs_rehash, _ := Verify("wrong", testBcryptHash(t, bcrypt.MinCost), config)
+	if needs_rehash {
+		t.Fatal("a wrong password must not ask for a rehash")
+	}
+}
@@ -0,0 +1,91 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+)
+
+var ErrWeakPassword = types.NewPlatformError(ErrorKind.Validation, "weak_password", "password does not meet policy")
+
+// Defaults follow NIST SP 800-63B, length matters more than composition.
+const default_min_length = 12
+const default_max_length = 128
+
+// PolicyViolations lists every rule of Config.App.Password.Policy the password
+// breaks. user_inputs, i.e. the username or email, may not appear in it.
+func PolicyViolations(password string, config types.Config, user_inputs ...string) []string {
+	policy := config.App.Password.Policy
+	min_length := policy.MinLength
+	if min_length == 0 {
+		min_length = default_min_length
+	}
+	max_length := policy.MaxLength
+	if max_length == 0 {
+		max_length = default_max_length
+	}
+
+	violations := []string{}
+	length := len([]rune(password))
+	if length < min_length {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters", min_length))
+	}
+	if length > max_length {
+		violations = append(violations, fmt.Sprintf("must be at most %d characters", max_length))
+	}
+
+	var has_digit, has_lower, has_upper, has_symbol bool
+	for _, character := range password {
+		switch {
+		case unicode.IsDigit(character):
+			has_digit = true
+		case unicode.IsLower(character):
+			has_lower = true
+		case unicode.IsUpper(character):
+			has_upper = true
+		case unicode.IsPunct(character) || unicode.IsSymbol(character) || unicode.IsSpace(character):
+			has_symbol = true
+		}
+	}
+	if policy.RequireDigit && !has_digit {
+		violations = append(violations, "must contain a digit")
+	}
+	if policy.RequireLowercase && !has_lower {
+		violations = append(violations, "must contain a lowercase letter")
+	}
+	if policy.RequireUppercase && !has_upper {
+		violations = append(violations, "must contain an uppercase letter")
+	}
+	if policy.RequireSymbol && !has_symbol {
+		violations = append(violations, "must contain a symbol")
+	}
+
+	lower_password := strings.ToLower(password)
+	for _, user_input := range user_inputs {
+		// Compare the local part of emails too
+		user_input = strings.ToLower(strings.SplitN(user_input, "@", 2)[0])
+		if len(user_input) >= 3 && strings.Contains(lower_password, user_input) {
+			violations = append(violations, "must not contain your username or email")
+			break
+		}
+	}
+	return violations
+}
+
+// CheckPolicy returns ErrWeakPassword with a field error per violation, if
+// there are any.
+func CheckPolicy(password string, config types.Config, user_inputs ...string) error {
+	violations := PolicyViolations(password, config, user_inputs...)
+	if len(violations) == 0 {
+		return nil
+	}
+	fields := make([]types.FieldError, 0, len(violations))
+	for _, violation := range violations {
+		fields = append(fields, types.FieldError{Field: "password", Message: violation})
+	}
+	return ErrWeakPassword.WithFields(fields...).Wrap(errors.New(strings.Join(violations, ", ")))
+}
@@ -0,0 +1,185 @@
+package security
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+	"github.com/thedanisaur/jfl_platform/types/TokenPurpose"
+	"github.com/thedanisaur/jfl_platform/util"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+// Action tokens are signed with the same keys as access tokens, the typ header
+// and the purpose audience keep one from being accepted as the other.
+const action_token_type = "jfl-action+jwt"
+
+const default_password_reset_expiration_ms = 15 * 60 * 1000
+const default_email_verification_expiration_ms = 24 * 60 * 60 * 1000
+
+var ErrActionTokenUsed = types.NewPlatformError(ErrorKind.Conflict, "action_token_used", "action token already used")
+
+// ActionTokenStore records consumed action tokens until they expire.
+type ActionTokenStore interface {
+	// Consume returns ErrActionTokenUsed when the token was already consumed
+	Consume(jti string, expires_at time.Time) error
+}
+
+type MemoryActionTokenStore struct {
+	mutex    sync.Mutex
+	consumed map[string]time.Time
+}
+
+func NewMemoryActionTokenStore() *MemoryActionTokenStore {
+	return &MemoryActionTokenStore{
+		consumed: map[string]time.Time{},
+	}
+}
+
+func (store *MemoryActionTokenStore) Consume(jti string, expires_at time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.consumed[jti]; ok {
+		return ErrActionTokenUsed
+	}
+	store.consumed[jti] = expires_at
+	return nil
+}
+
+// Purge drops consumed tokens that have expired, they fail validation anyway.
+func (store *MemoryActionTokenStore) Purge(cutoff time.Time) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for jti, expires_at := range store.consumed {
+		if expires_at.Before(cutoff) {
+			delete(store.consumed, jti)
+		}
+	}
+}
+
+func actionTokenExpiration(purpose string, config types.Config) (time.Duration, error) {
+	var expiration_ms int
+	switch purpose {
+	case TokenPurpose.PasswordReset:
+		expiration_ms = config.App.ActionTokens.PasswordResetExpirationMs
+		if expiration_ms == 0 {
+			expiration_ms = default_password_reset_expiration_ms
+		}
+	case TokenPurpose.EmailVerification:
+		expiration_ms = config.App.ActionTokens.EmailVerificationExpirationMs
+		if expiration_ms == 0 {
+			expiration_ms = default_email_verification_expiration_ms
+		}
+	default:
+		return 0, fmt.Errorf("unsupported token purpose: %s", purpose)
+	}
+	return time.Duration(expiration_ms) * time.Millisecond, nil
+}
+
+// GenerateActionToken signs a single use token for purpose. binding is hashed
+// into the token and must match again when it is used, pass the current
+// password hash for resets and the email address for verification.
+func GenerateActionToken(txid uuid.UUID, user_id uuid.UUID, purpose string, binding string, config types.Config, key_ring *KeyRing) (string, error) {
+	log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(GenerateActionToken))
+	expiration, err := actionTokenExpiration(purpose, config)
+	if err != nil {
+		return "", err
+	}
+	key_id, method, private_key, err := key_ring.SigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.New(method)
+	token.Header["kid"] = key_id
+	token.Header["typ"] = action_token_type
+	claims := token.Claims.(jwt.MapClaims)
+	claims["iat"] = time.Now().UTC().Unix()
+	claims["nbf"] = time.Now().UTC().Unix()
+	claims["exp"] = time.Now().Add(expiration).UTC().Unix()
+	claims["iss"] = config.App.Host.Issuer
+	claims["aud"] = purpose
+	claims["jti"] = uuid.New().String()
+	claims["sub"] = user_id.String()
+	claims["purpose"] = purpose
+	claims["bnd"] = hashToken(binding)
+	return token.SignedString(private_key)
+}
+
+// ParseActionToken validates the signature, typ header, expiry and purpose of
+// an action token without consuming it, so the caller can load the user to
+// check the binding first.
+func ParseActionToken(txid uuid.UUID, token string, purpose string, config types.Config, key_ring *KeyRing) (types.ActionTokenClaims, error) {
+	log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(ParseActionToken))
+	passed_claims, token_type, err := parseTypedToken(token, key_ring)
+	if err != nil {
+		return types.ActionTokenClaims{}, ErrInvalidToken
+	}
+	if token_type != action_token_type {
+		log.Printf("%s | token type %s is not %s\n", txid.String(), token_type, action_token_type)
+		return types.ActionTokenClaims{}, ErrInvalidToken
+	}
+	// The audience is the purpose, not the configured audience
+	action_config := config
+	action_config.App.Host.Audience = []string{purpose}
+	err = verifyClaims(passed_claims, action_config)
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return types.ActionTokenClaims{}, ErrInvalidToken
+	}
+	if passed_purpose, _ := passed_claims["purpose"].(string); passed_purpose != purpose {
+		log.Printf("%s | token purpose is not %s\n", txid.String(), purpose)
+		return types.ActionTokenClaims{}, ErrInvalidToken
+	}
+
+	subject, _ := passed_claims["sub"].(string)
+	user_id, err := uuid.Parse(subject)
+	if err != nil {
+		return types.ActionTokenClaims{}, ErrInvalidToken
+	}
+	jti, _ := passed_claims["jti"].(string)
+	binding_hash, _ := passed_claims["bnd"].(string)
+	expires_at, _ := passed_claims["exp"].(float64)
+	if jti == "" || binding_hash == "" {
+		return types.ActionTokenClaims{}, ErrInvalidToken
+	}
+	return types.ActionTokenClaims{
+		TokenID:     jti,
+		UserID:      user_id,
+		Purpose:     purpose,
+		BindingHash: binding_hash,
+		ExpiresAt:   time.Unix(int64(expires_at), 0).UTC(),
+	}, nil
+}
+
+// ConsumeActionToken checks the binding and marks the token used, a token can
+// only be consumed once.
+func ConsumeActionToken(txid uuid.UUID, action_claims types.ActionTokenClaims, binding string, store ActionTokenStore) error {
+	log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(ConsumeActionToken))
+	if subtle.ConstantTimeCompare([]byte(hashToken(binding)), []byte(action_claims.BindingHash)) != 1 {
+		log.Printf("%s | token binding no longer matches\n", txid.String())
+		return ErrInvalidToken
+	}
+	if store == nil {
+		return errors.New("no action token store configured")
+	}
+	err := store.Consume(action_claims.TokenID, action_claims.ExpiresAt)
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return err
+	}
+	return nil
+}
+
+// isActionToken keeps action tokens from being accepted as access tokens even
+// if they were to carry access token claims.
+func isActionToken(claims jwt.MapClaims) bool {
+	_, ok := claims["purpose"]
+	return ok
+}
@@ -0,0 +1,87 @@
+package security
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/types/TokenPurpose"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+func TestParseActionToken(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	user_id := uuid.New()
+	token, err := GenerateActionToken(uuid.New(), user_id, TokenPurpose.PasswordReset, "hash", config, key_ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	action_claims, err := ParseActionToken(uuid.New(), token, TokenPurpose.PasswordReset, config, key_ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action_claims.UserID != user_id {
+		t.Fatalf("unexpected user %s", action_claims.UserID)
+	}
+	_, err = ParseActionToken(uuid.New(), token, TokenPurpose.EmailVerification, config, key_ring)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("token must not be accepted for another purpose, got %v", err)
+	}
+
+	// Same claims signed with the access token typ
+	key_id, method, private_key, err := key_ring.SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	untyped := jwt.NewWithClaims(method, jwt.MapClaims{
+		"iat":     time.Now().UTC().Unix(),
+		"nbf":     time.Now().UTC().Unix(),
+		"exp":     time.Now().Add(time.Minute).UTC().Unix(),
+		"iss":     config.App.Host.Issuer,
+		"aud":     TokenPurpose.PasswordReset,
+		"jti":     uuid.New().String(),
+		"sub":     user_id.String(),
+		"purpose": TokenPurpose.PasswordReset,
+		"bnd":     hashToken("hash"),
+	})
+	untyped.Header["kid"] = key_id
+	untyped_token, err := untyped.SignedString(private_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseActionToken(uuid.New(), untyped_token, TokenPurpose.PasswordReset, config, key_ring)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("token without the action typ must be rejected, got %v", err)
+	}
+}
+
+func TestConsumeActionToken(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	store := NewMemoryActionTokenStore()
+	token, err := GenerateActionToken(uuid.New(), uuid.New(), TokenPurpose.PasswordReset, "hash", config, key_ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	action_claims, err := ParseActionToken(uuid.New(), token, TokenPurpose.PasswordReset, config, key_ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ConsumeActionToken(uuid.New(), action_claims, "changed", store)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("changed binding must be rejected, got %v", err)
+	}
+	err = ConsumeActionToken(uuid.New(), action_claims, "hash", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ConsumeActionToken(uuid.New(), action_claims, "hash", store)
+	if !errors.Is(err, ErrActionTokenUsed) {
+		t.Fatalf("token must only be consumed once, got %v", err)
+	}
+}
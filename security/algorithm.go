@@ -0,0 +1,129 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Only asymmetric algorithms are allowed, accepting HS* would let anyone
+// holding a public key mint tokens and `none` would skip verification entirely.
+var allowedSigningMethods = map[string]jwt.SigningMethod{
+	jwt.SigningMethodRS256.Alg(): jwt.SigningMethodRS256,
+	jwt.SigningMethodRS384.Alg(): jwt.SigningMethodRS384,
+	jwt.SigningMethodRS512.Alg(): jwt.SigningMethodRS512,
+	jwt.SigningMethodPS256.Alg(): jwt.SigningMethodPS256,
+	jwt.SigningMethodPS384.Alg(): jwt.SigningMethodPS384,
+	jwt.SigningMethodPS512.Alg(): jwt.SigningMethodPS512,
+	jwt.SigningMethodES256.Alg(): jwt.SigningMethodES256,
+	jwt.SigningMethodES384.Alg(): jwt.SigningMethodES384,
+	jwt.SigningMethodES512.Alg(): jwt.SigningMethodES512,
+	jwt.SigningMethodEdDSA.Alg(): jwt.SigningMethodEdDSA,
+}
+
+// signingMethodForKey resolves the algorithm a key is pinned to. An empty
+// algorithm picks the default for the key type.
+func signingMethodForKey(algorithm string, public_key crypto.PublicKey) (jwt.SigningMethod, error) {
+	if algorithm == "" {
+		algorithm = defaultAlgorithm(public_key)
+	}
+	method, ok := allowedSigningMethods[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", algorithm)
+	}
+	switch key := public_key.(type) {
+	case *rsa.PublicKey:
+		switch method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return method, nil
+		}
+	case *ecdsa.PublicKey:
+		if ecdsa_method, ok := method.(*jwt.SigningMethodECDSA); ok && ecdsa_method.CurveBits == key.Curve.Params().BitSize {
+			return method, nil
+		}
+	case ed25519.PublicKey:
+		if method == jwt.SigningMethodEdDSA {
+			return method, nil
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+	return nil, fmt.Errorf("key type does not match signing algorithm: %s", algorithm)
+}
+
+func defaultAlgorithm(public_key crypto.PublicKey) string {
+	switch key := public_key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256.Alg()
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256.Alg()
+		case elliptic.P384():
+			return jwt.SigningMethodES384.Alg()
+		case elliptic.P521():
+			return jwt.SigningMethodES512.Alg()
+		}
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA.Alg()
+	}
+	return ""
+}
+
+func publicKeyOf(private_key crypto.PrivateKey) (crypto.PublicKey, error) {
+	switch key := private_key.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey, nil
+	case *ecdsa.PrivateKey:
+		return &key.PublicKey, nil
+	case ed25519.PrivateKey:
+		return key.Public(), nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+// parsePrivateKeyFromPEM accepts RSA, EC and Ed25519 private keys.
+func parsePrivateKeyFromPEM(bytes []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("not a private key")
+	}
+	return key, nil
+}
+
+// parsePublicKeyFromPEM accepts RSA, EC and Ed25519 public keys.
+func parsePublicKeyFromPEM(bytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.New("not a public key")
+	}
+	return certificate.PublicKey, nil
+}
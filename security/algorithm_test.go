@@ -0,0 +1,171 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+func testPrivateKeys(t *testing.T) map[string]crypto.PrivateKey {
+	t.Helper()
+	p256_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384_key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa_key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.PrivateKey{
+		"p256":    p256_key,
+		"p384":    p384_key,
+		"ed25519": ed25519_key,
+		"rsa":     rsa_key,
+	}
+}
+
+func TestSignAndVerifyRoundTrip(t *testing.T) {
+	keys := testPrivateKeys(t)
+	tests := []struct {
+		key       string
+		algorithm string
+		expected  string
+	}{
+		{"p256", "", "ES256"},
+		{"p256", "ES256", "ES256"},
+		{"p384", "", "ES384"},
+		{"ed25519", "", "EdDSA"},
+		{"ed25519", "EdDSA", "EdDSA"},
+		{"rsa", "", "RS256"},
+		{"rsa", "PS256", "PS256"},
+	}
+	for _, test := range tests {
+		name := test.key + " default"
+		if test.algorithm != "" {
+			name = test.key + " " + test.algorithm
+		}
+		t.Run(name, func(t *testing.T) {
+			key_ring := NewKeyRing()
+			err := key_ring.AddSigningKey("test", test.algorithm, keys[test.key])
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := GenerateJWT(uuid.New(), testUserClaims(), testConfig(), key_ring)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed_token, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed_token.Method.Alg() != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, parsed_token.Method.Alg())
+			}
+			_, err = parseToken(token, key_ring)
+			if err != nil {
+				t.Fatalf("expected the token to verify, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSigningMethodForKeyRejectsMismatches(t *testing.T) {
+	keys := testPrivateKeys(t)
+	tests := []struct {
+		key       string
+		algorithm string
+	}{
+		{"p256", "ES384"},
+		{"p384", "ES256"},
+		{"p256", "EdDSA"},
+		{"rsa", "ES256"},
+		{"ed25519", "RS256"},
+		{"rsa", "HS256"},
+		{"p256", "none"},
+	}
+	for _, test := range tests {
+		public_key, err := publicKeyOf(keys[test.key])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = signingMethodForKey(test.algorithm, public_key)
+		if err == nil {
+			t.Fatalf("expected %s to be rejected for the %s key", test.algorithm, test.key)
+		}
+	}
+}
+
+// testSignedToken signs valid claims for the ring's "test" key with whatever
+// method and key the attacker picked.
+func testSignedToken(t *testing.T, method jwt.SigningMethod, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{
+		"iss":     "https://jfl.test",
+		"iat":     time.Now().UTC().Unix(),
+		"exp":     time.Now().Add(time.Minute).UTC().Unix(),
+		"user_id": uuid.New().String(),
+	})
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestParseTokenPinsTheAlgorithm(t *testing.T) {
+	keys := testPrivateKeys(t)
+	rsa_key := keys["rsa"].(*rsa.PrivateKey)
+	key_ring := NewKeyRing()
+	err := key_ring.AddSigningKey("test", "RS256", rsa_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsa_key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public_pem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	_, err = parseToken(testSignedToken(t, jwt.SigningMethodRS256, rsa_key), key_ring)
+	if err != nil {
+		t.Fatalf("expected the pinned algorithm to verify, got %v", err)
+	}
+	tests := []struct {
+		name  string
+		token string
+	}{
+		// A valid signature by the right key, but not with the pinned algorithm
+		{"other rsa algorithm", testSignedToken(t, jwt.SigningMethodPS256, rsa_key)},
+		{"hs256 with the public key", testSignedToken(t, jwt.SigningMethodHS256, public_pem)},
+		{"hs256 with the public key der", testSignedToken(t, jwt.SigningMethodHS256, der)},
+		{"none", testSignedToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType)},
+		{"other key", testSignedToken(t, jwt.SigningMethodES256, keys["p256"])},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseToken(test.token, key_ring)
+			if err == nil {
+				t.Fatal("expected the token to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+	"github.com/thedanisaur/jfl_platform/util"
+
+	"github.com/google/uuid"
+)
+
+const HeaderAPIKey = "X-API-Key"
+
+// api_key_prefix makes keys easy to spot in logs and secret scanners
+const api_key_prefix = "jfl"
+
+var ErrAPIKeyNotFound = types.NewPlatformError(ErrorKind.NotFound, "api_key_not_found", "api key not found")
+
+type APIKeyStore interface {
+	Save(api_key types.APIKey) error
+	// Get returns ErrAPIKeyNotFound when there is no key with the id
+	Get(id string) (types.APIKey, error)
+	Touch(id string, used_at time.Time) error
+	Revoke(id string) error
+}
+
+type MemoryAPIKeyStore struct {
+	mutex    sync.RWMutex
+	api_keys map[string]types.APIKey
+}
+
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{
+		api_keys: map[string]types.APIKey{},
+	}
+}
+
+func (store *MemoryAPIKeyStore) Save(api_key types.APIKey) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.api_keys[api_key.ID] = api_key
+	return nil
+}
+
+func (store *MemoryAPIKeyStore) Get(id string) (types.APIKey, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	api_key, ok := store.api_keys[id]
+	if !ok {
+		return types.APIKey{}, ErrAPIKeyNotFound
+	}
+	return api_key, nil
+}
+
+func (store *MemoryAPIKeyStore) Touch(id string, used_at time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	api_key, ok := store.api_keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	api_key.LastUsedAt = &used_at
+	store.api_keys[id] = api_key
+	return nil
+}
+
+func (store *MemoryAPIKeyStore) Revoke(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	api_key, ok := store.api_keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	api_key.Revoked = true
+	store.api_keys[id] = api_key
+	return nil
+}
+
+// GenerateAPIKey creates a key of the form jfl_<id>_<secret>. The key is only
+// returned here, the store keeps its hash. An empty resources list means the
+// key isn't restricted beyond its owner's policies.
+func GenerateAPIKey(txid uuid.UUID, name string, user_claims types.UserClaims, scopes []string, resources []string, expires_at *time.Time, store APIKeyStore) (string, types.APIKey, error) {
+	log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(GenerateAPIKey))
+	id_bytes := make([]byte, 8)
+	_, err := rand.Read(id_bytes)
+	if err != nil {
+		return "", types.APIKey{}, err
+	}
+	secret, err := generateOpaqueToken()
+	if err != nil {
+		return "", types.APIKey{}, err
+	}
+	id := hex.EncodeToString(id_bytes)
+	key := api_key_prefix + "_" + id + "_" + secret
+
+	// Keys don't carry sessions or impersonation, only the owner's identity
+	owner_claims := user_claims
+	owner_claims.SessionID = uuid.Nil
+	owner_claims.AuthenticationMethods = nil
+	owner_claims.Actor = nil
+	api_key := types.APIKey{
+		ID:         id,
+		Name:       name,
+		KeyHash:    hashToken(key),
+		UserClaims: owner_claims,
+		Scopes:     scopes,
+		Resources:  resources,
+		ExpiresAt:  expires_at,
+		CreatedOn:  time.Now().UTC(),
+	}
+	err = store.Save(api_key)
+	if err != nil {
+		return "", types.APIKey{}, err
+	}
+	return key, api_key, nil
+}
+
+// ValidateAPIKey checks the key against its stored hash, expiry and revocation,
+// records the use and returns the owner's claims restricted to the key.
+func ValidateAPIKey(txid uuid.UUID, key string, store APIKeyStore) (types.UserClaims, error) {
+	log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(ValidateAPIKey))
+	if store == nil {
+		return types.UserClaims{}, errors.New("api keys not enabled")
+	}
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != api_key_prefix || parts[1] == "" || parts[2] == "" {
+		return types.UserClaims{}, ErrInvalidAPIKey.Wrap(errors.New("malformed api key"))
+	}
+	api_key, err := store.Get(parts[1])
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return types.UserClaims{}, ErrInvalidAPIKey
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(api_key.KeyHash)) != 1 {
+		log.Printf("%s | api key %s hash mismatch\n", txid.String(), api_key.ID)
+		return types.UserClaims{}, ErrInvalidAPIKey
+	}
+	now := time.Now().UTC()
+	if api_key.Revoked {
+		log.Printf("%s | api key %s is revoked\n", txid.String(), api_key.ID)
+		return types.UserClaims{}, ErrInvalidAPIKey
+	}
+	if api_key.ExpiresAt != nil && now.After(*api_key.ExpiresAt) {
+		log.Printf("%s | api key %s expired\n", txid.String(), api_key.ID)
+		return types.UserClaims{}, ErrAPIKeyExpired
+	}
+	// A failed touch shouldn't fail the request
+	err = store.Touch(api_key.ID, now)
+	if err != nil {
+		log.Printf("%s | failed to record api key use: %s\n", txid.String(), err.Error())
+	}
+
+	user_claims := api_key.UserClaims
+	user_claims.APIKeyID = api_key.ID
+	user_claims.Scopes = api_key.Scopes
+	user_claims.Resources = api_key.Resources
+	return user_claims, nil
+}
+
+func RevokeAPIKey(txid uuid.UUID, id string, store APIKeyStore) error {
+	log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(RevokeAPIKey))
+	return store.Revoke(id)
+}
+
+// AllowsResource reports whether an API key restricted to resources may access
+// resource. Claims without restrictions allow every resource.
+func AllowsResource(resources []string, resource string) bool {
+	if len(resources) == 0 {
+		return true
+	}
+	for _, allowed := range resources {
+		if allowed == resource {
+			return true
+		}
+	}
+	return false
+}
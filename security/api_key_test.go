@@ -0,0 +1,103 @@
+package security
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestGenerateAPIKeyStoresOnlyTheHash(t *testing.T) {
+	store := NewMemoryAPIKeyStore()
+	user_claims := testUserClaims()
+	user_claims.SessionID = uuid.New()
+	key, api_key, err := GenerateAPIKey(uuid.New(), "integration", user_claims, []string{"read"}, nil, nil, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, api_key_prefix+"_"+api_key.ID+"_") {
+		t.Fatalf("unexpected key format %q", key)
+	}
+	stored, err := store.Get(api_key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.KeyHash != hashToken(key) || strings.Contains(stored.KeyHash, key) {
+		t.Fatal("the store must keep the hash of the key, not the key")
+	}
+	if stored.UserClaims.SessionID != uuid.Nil {
+		t.Fatal("keys must not carry the owner's session")
+	}
+}
+
+func TestValidateAPIKey(t *testing.T) {
+	store := NewMemoryAPIKeyStore()
+	user_claims := testUserClaims()
+	past := time.Now().UTC().Add(-time.Minute)
+	future := time.Now().UTC().Add(time.Hour)
+
+	key, api_key, err := GenerateAPIKey(uuid.New(), "valid", user_claims, []string{"read"}, []string{"logs"}, &future, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired_key, _, err := GenerateAPIKey(uuid.New(), "expired", user_claims, nil, nil, &past, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked_key, revoked, err := GenerateAPIKey(uuid.New(), "revoked", user_claims, nil, nil, nil, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RevokeAPIKey(uuid.New(), revoked.ID, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		err  error
+	}{
+		{"valid", key, nil},
+		{"wrong secret", key[:strings.LastIndex(key, "_")] + "_secret", ErrInvalidAPIKey},
+		{"unknown id", api_key_prefix + "_0000000000000000_secret", ErrInvalidAPIKey},
+		{"wrong prefix", "abc" + key[len(api_key_prefix):], ErrInvalidAPIKey},
+		{"malformed", "jfl_only", ErrInvalidAPIKey},
+		{"expired", expired_key, ErrAPIKeyExpired},
+		{"revoked", revoked_key, ErrInvalidAPIKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ValidateAPIKey(uuid.New(), test.key, store)
+			if test.err == nil && err != nil {
+				t.Fatalf("expected valid, got %v", err)
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	validated, err := ValidateAPIKey(uuid.New(), key, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validated.UserID != user_claims.UserID || validated.APIKeyID != api_key.ID {
+		t.Fatalf("unexpected claims %+v", validated)
+	}
+	if !HasScopes(validated.Scopes, []string{"read"}) || HasScopes(validated.Scopes, []string{"write"}) {
+		t.Fatalf("unexpected scopes %v", validated.Scopes)
+	}
+	if !AllowsResource(validated.Resources, "logs") || AllowsResource(validated.Resources, "aircrew") {
+		t.Fatalf("unexpected resources %v", validated.Resources)
+	}
+	stored, err := store.Get(api_key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LastUsedAt == nil {
+		t.Fatal("use of the key wasn't recorded")
+	}
+}
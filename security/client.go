@@ -0,0 +1,133 @@
+package security
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/types"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+// GenerateClientJWT mints a token for a machine client. Client tokens carry
+// `client_id` and `scope` in place of the user claims so they can never be
+// mistaken for a user's token by ValidateJWT.
+func GenerateClientJWT(txid uuid.UUID, client_claims types.ClientClaims, config types.Config, key_ring *KeyRing) (string, error) {
+	key_id, method, private_key, err := key_ring.SigningKey()
+	if err != nil {
+		return "", err
+	}
+	if config.App.Host.SigningAlgorithm != "" && config.App.Host.SigningAlgorithm != method.Alg() {
+		return "", fmt.Errorf("signing key %s does not use %s", key_id, config.App.Host.SigningAlgorithm)
+	}
+	expiration_ms := config.App.ClientExpirationMs
+	if expiration_ms == 0 {
+		expiration_ms = config.App.LoginExpirationMs
+	}
+	token := jwt.New(method)
+	token.Header["kid"] = key_id
+	claims := token.Claims.(jwt.MapClaims)
+	claims["iat"] = issuedAt(time.Now().UTC())
+	claims["nbf"] = time.Now().UTC().Unix()
+	claims["exp"] = time.Now().Add(time.Duration(expiration_ms) * time.Millisecond).UTC().Unix()
+	claims["iss"] = config.App.Host.Issuer
+	if len(config.App.Host.IssuedAudience) > 0 {
+		claims["aud"] = config.App.Host.IssuedAudience
+	}
+	claims["jti"] = txid.String()
+	claims["sub"] = client_claims.ClientID
+	claims["client_id"] = client_claims.ClientID
+	claims["scope"] = strings.Join(client_claims.Scopes, " ")
+	signed_token, err := token.SignedString(private_key)
+	if err != nil {
+		return "", err
+	}
+
+	return signed_token, nil
+}
+
+func mapToClientClaims(txid uuid.UUID, claims map[string]interface{}) (types.ClientClaims, error) {
+	client_claims := types.ClientClaims{}
+
+	client_id, ok := claims["client_id"].(string)
+	if !ok || client_id == "" {
+		log.Printf("%s | missing client id\n", txid.String())
+		return client_claims, ErrInvalidToken
+	}
+	client_claims.ClientID = client_id
+	scope, ok := claims["scope"].(string)
+	if !ok {
+		log.Printf("%s | missing scope\n", txid.String())
+		return client_claims, ErrInvalidToken
+	}
+	client_claims.Scopes = strings.Fields(scope)
+
+	return client_claims, nil
+}
+
+func isClientToken(claims jwt.MapClaims) bool {
+	_, ok := claims["client_id"]
+	return ok
+}
+
+func ValidateClientJWT(txid uuid.UUID, c *fiber.Ctx, config types.Config, key_ring *KeyRing, revocation_store RevocationStore) (types.ClientClaims, error) {
+	passed_claims, err := validateBearer(c, config, key_ring)
+	if err != nil {
+		return types.ClientClaims{}, err
+	}
+	return validateClientClaims(txid, passed_claims, revocation_store)
+}
+
+func validateClientClaims(txid uuid.UUID, passed_claims jwt.MapClaims, revocation_store RevocationStore) (types.ClientClaims, error) {
+	client_claims, err := mapToClientClaims(txid, passed_claims)
+	if err != nil {
+		return client_claims, err
+	}
+	err = checkRevocation(txid, passed_claims, uuid.Nil, revocation_store)
+	if err != nil {
+		return types.ClientClaims{}, err
+	}
+	return client_claims, nil
+}
+
+// ValidateAnyJWT accepts either a user or a client token. Exactly one of the
+// returned claims is set, the other is nil.
+func ValidateAnyJWT(txid uuid.UUID, c *fiber.Ctx, config types.Config, key_ring *KeyRing, revocation_store RevocationStore) (*types.UserClaims, *types.ClientClaims, error) {
+	passed_claims, err := validateBearer(c, config, key_ring)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isClientToken(passed_claims) {
+		client_claims, err := validateClientClaims(txid, passed_claims, revocation_store)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, &client_claims, nil
+	}
+	user_claims, err := validateUserClaims(txid, passed_claims, revocation_store)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &user_claims, nil, nil
+}
+
+// HasScopes reports whether every required scope was granted.
+func HasScopes(granted []string, required []string) bool {
+	for _, required_scope := range required {
+		found := false
+		for _, granted_scope := range granted {
+			if granted_scope == required_scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
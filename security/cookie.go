@@ -0,0 +1,272 @@
+package security
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/CSRFMode"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+	"github.com/thedanisaur/jfl_platform/util"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const HeaderCSRFToken = "X-CSRF-Token"
+
+const default_session_cookie_name = "jfl_session"
+const default_csrf_cookie_name = "jfl_csrf"
+const default_refresh_cookie_name = "jfl_refresh"
+
+var ErrInvalidCSRFToken = types.NewPlatformError(ErrorKind.Forbidden, "invalid_csrf_token", "invalid csrf token")
+
+// CSRFTokenStore holds synchronizer tokens by session id.
+type CSRFTokenStore interface {
+	Save(session_id uuid.UUID, token_hash string, expires_at time.Time) error
+	// Get returns an empty hash when the session has no token
+	Get(session_id uuid.UUID) (string, error)
+	Remove(session_id uuid.UUID) error
+}
+
+type csrfToken struct {
+	token_hash string
+	expires_at time.Time
+}
+
+type MemoryCSRFTokenStore struct {
+	mutex  sync.Mutex
+	tokens map[uuid.UUID]csrfToken
+}
+
+func NewMemoryCSRFTokenStore() *MemoryCSRFTokenStore {
+	return &MemoryCSRFTokenStore{
+		tokens: map[uuid.UUID]csrfToken{},
+	}
+}
+
+func (store *MemoryCSRFTokenStore) Save(session_id uuid.UUID, token_hash string, expires_at time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.tokens[session_id] = csrfToken{token_hash: token_hash, expires_at: expires_at}
+	return nil
+}
+
+func (store *MemoryCSRFTokenStore) Get(session_id uuid.UUID) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	token, ok := store.tokens[session_id]
+	if !ok {
+		return "", nil
+	}
+	if time.Now().UTC().After(token.expires_at) {
+		delete(store.tokens, session_id)
+		return "", nil
+	}
+	return token.token_hash, nil
+}
+
+func (store *MemoryCSRFTokenStore) Remove(session_id uuid.UUID) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.tokens, session_id)
+	return nil
+}
+
+func sessionCookieName(config types.Config) string {
+	if config.App.Cookie.Name == "" {
+		return default_session_cookie_name
+	}
+	return config.App.Cookie.Name
+}
+
+func csrfCookieName(config types.Config) string {
+	if config.App.Cookie.CSRFCookieName == "" {
+		return default_csrf_cookie_name
+	}
+	return config.App.Cookie.CSRFCookieName
+}
+
+func refreshCookieName(config types.Config) string {
+	if config.App.Cookie.RefreshCookieName == "" {
+		return default_refresh_cookie_name
+	}
+	return config.App.Cookie.RefreshCookieName
+}
+
+// newRefreshCookie is scoped to Config.App.Cookie.RefreshPath, the cookie path
+// when it isn't set.
+func newRefreshCookie(value string, expires_at time.Time, config types.Config) *fiber.Cookie {
+	cookie := newCookie(refreshCookieName(config), value, true, expires_at, config)
+	if config.App.Cookie.RefreshPath != "" {
+		cookie.Path = config.App.Cookie.RefreshPath
+	}
+	return cookie
+}
+
+// sameSite defaults to Lax, or None when cross origin credentials are allowed
+// since the browser wouldn't send the cookie otherwise.
+func sameSite(config types.Config) string {
+	if config.App.Cookie.SameSite != "" {
+		return config.App.Cookie.SameSite
+	}
+	if config.App.Cors.AllowCredentials {
+		return fiber.CookieSameSiteNoneMode
+	}
+	return fiber.CookieSameSiteLaxMode
+}
+
+func newCookie(name string, value string, http_only bool, expires_at time.Time, config types.Config) *fiber.Cookie {
+	path := config.App.Cookie.Path
+	if path == "" {
+		path = "/"
+	}
+	return &fiber.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   config.App.Cookie.Domain,
+		Expires:  expires_at,
+		Secure:   true,
+		HTTPOnly: http_only,
+		SameSite: sameSite(config),
+	}
+}
+
+// SetSessionCookie sets the access token in an HttpOnly cookie so the page
+// never has to hold it.
+func SetSessionCookie(c *fiber.Ctx, token string, expires_at time.Time, config types.Config) {
+	c.Cookie(newCookie(sessionCookieName(config), token, true, expires_at, config))
+}
+
+// SetRefreshCookie sets the refresh token in an HttpOnly cookie that is only
+// sent to the refresh endpoint, see Config.App.Cookie.RefreshPath.
+func SetRefreshCookie(c *fiber.Ctx, token string, expires_at time.Time, config types.Config) {
+	c.Cookie(newRefreshCookie(token, expires_at, config))
+}
+
+// RefreshCookieToken returns the refresh token from the refresh cookie, empty
+// when cookie sessions aren't enabled.
+func RefreshCookieToken(c *fiber.Ctx, config types.Config) string {
+	if !config.App.Cookie.Enabled {
+		return ""
+	}
+	return c.Cookies(refreshCookieName(config))
+}
+
+// ClearSessionCookie expires the session, refresh and double submit cookies.
+func ClearSessionCookie(c *fiber.Ctx, config types.Config) {
+	expired := time.Unix(0, 0)
+	c.Cookie(newCookie(sessionCookieName(config), "", true, expired, config))
+	c.Cookie(newRefreshCookie("", expired, config))
+	if config.App.Cookie.CSRFMode == CSRFMode.DoubleSubmit {
+		c.Cookie(newCookie(csrfCookieName(config), "", false, expired, config))
+	}
+}
+
+// SessionCookieToken returns the access token from the session cookie. The
+// Authorization header takes precedence, so this is empty when it is set.
+func SessionCookieToken(c *fiber.Ctx, config types.Config) string {
+	if !config.App.Cookie.Enabled || c.Get(fiber.HeaderAuthorization) != "" {
+		return ""
+	}
+	return c.Cookies(sessionCookieName(config))
+}
+
+// IssueCSRFToken creates the CSRF token for a cookie session. Double submit
+// tokens are set in a cookie the page can read, synchronizer tokens are
+// stored against the session. Either way the token is also returned in the
+// X-CSRF-Token response header.
+func IssueCSRFToken(txid uuid.UUID, c *fiber.Ctx, user_claims types.UserClaims, expires_at time.Time, config types.Config, store CSRFTokenStore) (string, error) {
+	log.Printf("%s | %s\n", txid.String(), util.GetFunctionName(IssueCSRFToken))
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	switch config.App.Cookie.CSRFMode {
+	case CSRFMode.DoubleSubmit:
+		c.Cookie(newCookie(csrfCookieName(config), token, false, expires_at, config))
+	case CSRFMode.Synchronizer:
+		if store == nil || user_claims.SessionID == uuid.Nil {
+			return "", errors.New("synchronizer csrf tokens require a store and a session")
+		}
+		err = store.Save(user_claims.SessionID, hashToken(token), expires_at)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported csrf mode: %s", config.App.Cookie.CSRFMode)
+	}
+	c.Set(HeaderCSRFToken, token)
+	return token, nil
+}
+
+// VerifyCSRFToken protects requests authenticated by the session cookie.
+// Cross origin requests are only accepted from Config.App.Cors.AllowOrigins
+// when Config.App.Cors.AllowCredentials is set, and unsafe methods must carry
+// the CSRF token in the X-CSRF-Token header.
+func VerifyCSRFToken(txid uuid.UUID, c *fiber.Ctx, user_claims types.UserClaims, config types.Config, store CSRFTokenStore) error {
+	err := verifyCookieOrigin(c, config)
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return ErrInvalidCSRFToken
+	}
+	method := c.Method()
+	if method == fiber.MethodGet || method == fiber.MethodHead || method == fiber.MethodOptions {
+		return nil
+	}
+
+	token := c.Get(HeaderCSRFToken)
+	if token == "" {
+		log.Printf("%s | missing csrf token\n", txid.String())
+		return ErrInvalidCSRFToken
+	}
+	var expected string
+	switch config.App.Cookie.CSRFMode {
+	case CSRFMode.DoubleSubmit:
+		expected = c.Cookies(csrfCookieName(config))
+	case CSRFMode.Synchronizer:
+		if store == nil {
+			return errors.New("no csrf token store configured")
+		}
+		token_hash, err := store.Get(user_claims.SessionID)
+		if err != nil {
+			return err
+		}
+		if token_hash == "" {
+			log.Printf("%s | no csrf token for session %s\n", txid.String(), user_claims.SessionID.String())
+			return ErrInvalidCSRFToken
+		}
+		expected = token_hash
+		token = hashToken(token)
+	default:
+		return fmt.Errorf("unsupported csrf mode: %s", config.App.Cookie.CSRFMode)
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		log.Printf("%s | csrf token mismatch\n", txid.String())
+		return ErrInvalidCSRFToken
+	}
+	return nil
+}
+
+func verifyCookieOrigin(c *fiber.Ctx, config types.Config) error {
+	origin := c.Get(fiber.HeaderOrigin)
+	if origin == "" || origin == c.BaseURL() {
+		return nil
+	}
+	if !config.App.Cors.AllowCredentials {
+		return fmt.Errorf("cross origin cookie request from %s", origin)
+	}
+	for _, allowed_origin := range config.App.Cors.AllowOrigins {
+		// Browsers refuse credentials for a wildcard origin, so never match it
+		if allowed_origin != "*" && strings.EqualFold(strings.TrimSuffix(allowed_origin, "/"), origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s not allowed", origin)
+}
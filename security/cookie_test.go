@@ -0,0 +1,156 @@
+package security
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/CSRFMode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// testVerifyCSRF reports the VerifyCSRFToken result for the request.
+func testVerifyCSRF(t *testing.T, request *http.Request, user_claims types.UserClaims, config types.Config, store CSRFTokenStore) error {
+	t.Helper()
+	var err error
+	testRequest(t, request, func(c *fiber.Ctx) error {
+		err = VerifyCSRFToken(uuid.New(), c, user_claims, config, store)
+		return nil
+	})
+	return err
+}
+
+// testIssueCSRF returns the token IssueCSRFToken put in the response header.
+func testIssueCSRF(t *testing.T, user_claims types.UserClaims, config types.Config, store CSRFTokenStore) (string, *http.Response) {
+	t.Helper()
+	var err error
+	response := testRequest(t, nil, func(c *fiber.Ctx) error {
+		_, err = IssueCSRFToken(uuid.New(), c, user_claims, time.Now().UTC().Add(time.Minute), config, store)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.Header.Get(HeaderCSRFToken), response
+}
+
+func TestDoubleSubmitCSRFToken(t *testing.T) {
+	config := testConfig()
+	config.App.Cookie.Enabled = true
+	config.App.Cookie.CSRFMode = CSRFMode.DoubleSubmit
+	user_claims := testUserClaims()
+	token, response := testIssueCSRF(t, user_claims, config, nil)
+	var cookie *http.Cookie
+	for _, response_cookie := range response.Cookies() {
+		if response_cookie.Name == default_csrf_cookie_name {
+			cookie = response_cookie
+		}
+	}
+	if token == "" || cookie == nil || cookie.Value != token || cookie.HttpOnly {
+		t.Fatalf("double submit token must be in the header and a readable cookie: %q %+v", token, cookie)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		header string
+		cookie string
+		origin string
+		valid  bool
+	}{
+		{"matching", fiber.MethodPost, token, token, "", true},
+		{"safe method without token", fiber.MethodGet, "", "", "", true},
+		{"missing header", fiber.MethodPost, "", token, "", false},
+		{"missing cookie", fiber.MethodPost, token, "", "", false},
+		{"mismatch", fiber.MethodPost, token, "other", "", false},
+		{"cross origin", fiber.MethodPost, token, token, "https://evil.test", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, "/", nil)
+			if test.header != "" {
+				request.Header.Set(HeaderCSRFToken, test.header)
+			}
+			if test.cookie != "" {
+				request.AddCookie(&http.Cookie{Name: default_csrf_cookie_name, Value: test.cookie})
+			}
+			if test.origin != "" {
+				request.Header.Set(fiber.HeaderOrigin, test.origin)
+			}
+			err := testVerifyCSRF(t, request, user_claims, config, nil)
+			if test.valid && err != nil {
+				t.Fatalf("expected valid, got %v", err)
+			}
+			if !test.valid && !errors.Is(err, ErrInvalidCSRFToken) {
+				t.Fatalf("expected invalid csrf token, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSynchronizerCSRFToken(t *testing.T) {
+	config := testConfig()
+	config.App.Cookie.Enabled = true
+	config.App.Cookie.CSRFMode = CSRFMode.Synchronizer
+	store := NewMemoryCSRFTokenStore()
+	user_claims := testUserClaims()
+
+	// Synchronizer tokens are bound to a session
+	var err error
+	testRequest(t, nil, func(c *fiber.Ctx) error {
+		_, err = IssueCSRFToken(uuid.New(), c, user_claims, time.Now().UTC().Add(time.Minute), config, store)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected an error without a session")
+	}
+
+	user_claims.SessionID = uuid.New()
+	token, _ := testIssueCSRF(t, user_claims, config, store)
+	other_session := user_claims
+	other_session.SessionID = uuid.New()
+
+	tests := []struct {
+		name        string
+		header      string
+		user_claims types.UserClaims
+		valid       bool
+	}{
+		{"issued token", token, user_claims, true},
+		{"wrong token", "other", user_claims, false},
+		{"missing token", "", user_claims, false},
+		{"other session", token, other_session, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(fiber.MethodPost, "/", nil)
+			if test.header != "" {
+				request.Header.Set(HeaderCSRFToken, test.header)
+			}
+			err := testVerifyCSRF(t, request, test.user_claims, config, store)
+			if test.valid && err != nil {
+				t.Fatalf("expected valid, got %v", err)
+			}
+			if !test.valid && !errors.Is(err, ErrInvalidCSRFToken) {
+				t.Fatalf("expected invalid csrf token, got %v", err)
+			}
+		})
+	}
+
+	// Logging out removes the token
+	err = store.Remove(user_claims.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(fiber.MethodPost, "/", nil)
+	request.Header.Set(HeaderCSRFToken, token)
+	err = testVerifyCSRF(t, request, user_claims, config, store)
+	if !errors.Is(err, ErrInvalidCSRFToken) {
+		t.Fatalf("expected invalid csrf token after logout, got %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+package security
+
+import (
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+)
+
+// Errors returned while authenticating a request. The reason a token was
+// rejected is logged, clients only get the code.
+var ErrMissingCredentials = types.NewPlatformError(ErrorKind.Unauthenticated, "missing_credentials", "missing credentials")
+var ErrInvalidToken = types.NewPlatformError(ErrorKind.Unauthenticated, "invalid_token", "invalid token")
+var ErrTokenExpired = types.NewPlatformError(ErrorKind.TokenExpired, "token_expired", "token expired")
+var ErrTokenRevoked = types.NewPlatformError(ErrorKind.Unauthenticated, "token_revoked", "token revoked")
+var ErrInvalidAPIKey = types.NewPlatformError(ErrorKind.Unauthenticated, "invalid_api_key", "invalid api key")
+var ErrAPIKeyExpired = types.NewPlatformError(ErrorKind.TokenExpired, "api_key_expired", "api key expired")
+var ErrInvalidRefreshToken = types.NewPlatformError(ErrorKind.Unauthenticated, "invalid_refresh_token", "invalid refresh token")
+var ErrRefreshTokenExpired = types.NewPlatformError(ErrorKind.TokenExpired, "refresh_token_expired", "refresh token expired")
+var ErrInvalidClientCertificate = types.NewPlatformError(ErrorKind.Unauthenticated, "invalid_client_certificate", "invalid client certificate")
+var ErrInsufficientScope = types.NewPlatformError(ErrorKind.Forbidden, "insufficient_scope", "insufficient scope")
@@ -0,0 +1,78 @@
+package security
+
+import (
+	"log"
+
+	"github.com/thedanisaur/jfl_platform/types"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+// IntrospectToken validates a raw token exactly like ValidateJWT does and
+// describes it. Tokens that fail validation for any reason are reported as
+// inactive rather than as an error.
+func IntrospectToken(txid uuid.UUID, token string, config types.Config, key_ring *KeyRing, revocation_store RevocationStore) types.IntrospectionResponse {
+	passed_claims, err := parseToken(token, key_ring)
+	if err != nil || isActionToken(passed_claims) {
+		return types.IntrospectionResponse{Active: false}
+	}
+	err = verifyClaims(passed_claims, config)
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return types.IntrospectionResponse{Active: false}
+	}
+
+	response := types.IntrospectionResponse{
+		Active:    true,
+		TokenType: "Bearer",
+		ExpiresAt: int64Claim(passed_claims, "exp"),
+		IssuedAt:  int64Claim(passed_claims, "iat"),
+		NotBefore: int64Claim(passed_claims, "nbf"),
+		Audience:  audienceClaim(passed_claims),
+	}
+	response.Issuer, _ = passed_claims["iss"].(string)
+	response.TokenID, _ = passed_claims["jti"].(string)
+
+	if isClientToken(passed_claims) {
+		client_claims, err := validateClientClaims(txid, passed_claims, revocation_store)
+		if err != nil {
+			log.Printf("%s | %s\n", txid.String(), err.Error())
+			return types.IntrospectionResponse{Active: false}
+		}
+		response.ClientID = client_claims.ClientID
+		response.Subject = client_claims.ClientID
+		response.Scope, _ = passed_claims["scope"].(string)
+		return response
+	}
+
+	user_claims, err := validateUserClaims(txid, passed_claims, revocation_store)
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return types.IntrospectionResponse{Active: false}
+	}
+	response.Subject = user_claims.UserID.String()
+	response.UserClaims = &user_claims
+	return response
+}
+
+func int64Claim(claims jwt.MapClaims, name string) int64 {
+	value, _ := claims[name].(float64)
+	return int64(value)
+}
+
+func audienceClaim(claims jwt.MapClaims) []string {
+	switch audience := claims["aud"].(type) {
+	case string:
+		return []string{audience}
+	case []interface{}:
+		audiences := []string{}
+		for _, value := range audience {
+			if value_string, ok := value.(string); ok {
+				audiences = append(audiences, value_string)
+			}
+		}
+		return audiences
+	}
+	return nil
+}
@@ -0,0 +1,539 @@
+package security
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/types"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var ErrMissingPassphrase = errors.New("key is encrypted but no passphrase is configured")
+var ErrIncorrectPassphrase = errors.New("incorrect key passphrase")
+
+// Key files are PEM (PKCS#1, SEC 1, PKCS#8, encrypted PKCS#8 or legacy
+// encrypted PEM), or JWK json holding a single key or a key set.
+var key_file_extensions = map[string]bool{".pem": true, ".key": true, ".jwk": true, ".json": true}
+
+const default_reload_interval_ms = 30 * 1000
+
+var (
+	oid_pbes2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oid_pbkdf2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oid_hmac_sha1      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oid_hmac_sha256    = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oid_aes_128_cbc    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oid_aes_192_cbc    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oid_aes_256_cbc    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	aes_cbc_key_length = map[string]int{
+		oid_aes_128_cbc.String(): 16,
+		oid_aes_192_cbc.String(): 24,
+		oid_aes_256_cbc.String(): 32,
+	}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Parameters struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Parameters struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// keyFileEntry is one key read from a key file, JWK sets hold several.
+type keyFileEntry struct {
+	key_id      string
+	algorithm   string
+	private_key crypto.PrivateKey
+	public_key  crypto.PublicKey
+}
+
+// KeyPassphrase reads the passphrase for encrypted keys from
+// Config.App.Keys.PassphraseEnv or Config.App.Keys.PassphraseFile. It is nil
+// when neither is configured.
+func KeyPassphrase(config types.Config) ([]byte, error) {
+	if config.App.Keys.PassphraseEnv != "" {
+		passphrase, ok := os.LookupEnv(config.App.Keys.PassphraseEnv)
+		if !ok {
+			return nil, fmt.Errorf("passphrase variable %s is not set", config.App.Keys.PassphraseEnv)
+		}
+		return []byte(passphrase), nil
+	}
+	if config.App.Keys.PassphraseFile != "" {
+		passphrase, err := os.ReadFile(config.App.Keys.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(passphrase, "\r\n"), nil
+	}
+	return nil, nil
+}
+
+// LoadPrivateKeyFile loads an RSA, EC or Ed25519 private key from a PEM or JWK
+// file, decrypting it with passphrase when it is encrypted.
+func LoadPrivateKeyFile(path string, passphrase []byte) (crypto.PrivateKey, error) {
+	entries, err := readKeyFile(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 || entries[0].private_key == nil {
+		return nil, errors.New("not a private key")
+	}
+	return entries[0].private_key, nil
+}
+
+// LoadPublicKeyFile loads an RSA, EC or Ed25519 public key from a PEM or JWK
+// file. The public half of a private key file is returned as well.
+func LoadPublicKeyFile(path string, passphrase []byte) (crypto.PublicKey, error) {
+	entries, err := readKeyFile(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, errors.New("expected a single key")
+	}
+	return entries[0].public_key, nil
+}
+
+func readKeyFile(path string, passphrase []byte) ([]keyFileEntry, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(contents)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJSONWebKeyFile(trimmed)
+	}
+	private_key, err := parsePrivateKeyFromPEMWithPassphrase(contents, passphrase)
+	if err == nil {
+		public_key, err := publicKeyOf(private_key)
+		if err != nil {
+			return nil, err
+		}
+		return []keyFileEntry{{private_key: private_key, public_key: public_key}}, nil
+	}
+	// An encrypted key is never a public key, i.e. report an unsupported cipher
+	if errors.Is(err, ErrMissingPassphrase) || errors.Is(err, ErrIncorrectPassphrase) || isEncryptedPEM(contents) {
+		return nil, err
+	}
+	public_key, err := parsePublicKeyFromPEM(contents)
+	if err != nil {
+		return nil, err
+	}
+	return []keyFileEntry{{public_key: public_key}}, nil
+}
+
+// parsePrivateKeyFromPEMWithPassphrase decrypts encrypted PKCS#8 and legacy
+// encrypted PEM blocks before handing them to parsePrivateKeyFromPEM.
+func parsePrivateKeyFromPEMWithPassphrase(contents []byte, passphrase []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		if len(passphrase) == 0 {
+			return nil, ErrMissingPassphrase
+		}
+		der, err := decryptPKCS8(block.Bytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParsePKCS8PrivateKey(der)
+	// Legacy encrypted PEM is deprecated but still what `openssl genrsa -aes256` writes
+	case x509.IsEncryptedPEMBlock(block):
+		if len(passphrase) == 0 {
+			return nil, ErrMissingPassphrase
+		}
+		der, err := x509.DecryptPEMBlock(block, passphrase)
+		if err != nil {
+			return nil, ErrIncorrectPassphrase
+		}
+		return parsePrivateKeyFromPEM(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}))
+	}
+	return parsePrivateKeyFromPEM(contents)
+}
+
+func isEncryptedPEM(contents []byte) bool {
+	block, _ := pem.Decode(contents)
+	return block != nil && (block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block))
+}
+
+// decryptPKCS8 supports PBES2 with PBKDF2 and AES-CBC, which is what OpenSSL
+// writes by default.
+func decryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	_, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oid_pbes2) {
+		return nil, fmt.Errorf("unsupported key encryption: %s", info.Algorithm.Algorithm.String())
+	}
+	var parameters pbes2Parameters
+	_, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &parameters)
+	if err != nil {
+		return nil, err
+	}
+	if !parameters.KeyDerivationFunc.Algorithm.Equal(oid_pbkdf2) {
+		return nil, fmt.Errorf("unsupported key derivation: %s", parameters.KeyDerivationFunc.Algorithm.String())
+	}
+	var kdf_parameters pbkdf2Parameters
+	_, err = asn1.Unmarshal(parameters.KeyDerivationFunc.Parameters.FullBytes, &kdf_parameters)
+	if err != nil {
+		return nil, err
+	}
+	var prf func() hash.Hash
+	switch {
+	case len(kdf_parameters.PRF.Algorithm) == 0, kdf_parameters.PRF.Algorithm.Equal(oid_hmac_sha1):
+		prf = sha1.New
+	case kdf_parameters.PRF.Algorithm.Equal(oid_hmac_sha256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported key derivation prf: %s", kdf_parameters.PRF.Algorithm.String())
+	}
+	key_length, ok := aes_cbc_key_length[parameters.EncryptionScheme.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported key cipher: %s", parameters.EncryptionScheme.Algorithm.String())
+	}
+	var iv []byte
+	_, err = asn1.Unmarshal(parameters.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil {
+		return nil, err
+	}
+
+	key := pbkdf2.Key(passphrase, kdf_parameters.Salt, kdf_parameters.IterationCount, key_length, prf)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid encrypted key")
+	}
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.EncryptedData)
+	// A wrong passphrase almost always shows up as bad padding
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, ErrIncorrectPassphrase
+	}
+	for _, value := range plain[len(plain)-padding:] {
+		if int(value) != padding {
+			return nil, ErrIncorrectPassphrase
+		}
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+func parseJSONWebKeyFile(contents []byte) ([]keyFileEntry, error) {
+	var key_set JSONWebKeySet
+	err := json.Unmarshal(contents, &key_set)
+	if err != nil {
+		return nil, err
+	}
+	if len(key_set.Keys) == 0 {
+		var json_web_key JSONWebKey
+		err = json.Unmarshal(contents, &json_web_key)
+		if err != nil {
+			return nil, err
+		}
+		key_set.Keys = []JSONWebKey{json_web_key}
+	}
+	entries := []keyFileEntry{}
+	for _, json_web_key := range key_set.Keys {
+		if json_web_key.Use != "" && json_web_key.Use != "sig" {
+			continue
+		}
+		entry := keyFileEntry{
+			key_id:    json_web_key.KeyID,
+			algorithm: json_web_key.Algorithm,
+		}
+		entry.public_key, err = json_web_key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %s: %w", json_web_key.KeyID, err)
+		}
+		if json_web_key.D != "" {
+			entry.private_key, err = json_web_key.privateKey(entry.public_key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse key %s: %w", json_web_key.KeyID, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (json_web_key JSONWebKey) privateKey(public_key crypto.PublicKey) (crypto.PrivateKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		bytes, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes) == 0 {
+			return nil, errors.New("missing key parameter")
+		}
+		return new(big.Int).SetBytes(bytes), nil
+	}
+	switch key := public_key.(type) {
+	case *rsa.PublicKey:
+		d, err := decode(json_web_key.D)
+		if err != nil {
+			return nil, err
+		}
+		p, err := decode(json_web_key.P)
+		if err != nil {
+			return nil, err
+		}
+		q, err := decode(json_web_key.Q)
+		if err != nil {
+			return nil, err
+		}
+		private_key := &rsa.PrivateKey{PublicKey: *key, D: d, Primes: []*big.Int{p, q}}
+		err = private_key.Validate()
+		if err != nil {
+			return nil, err
+		}
+		private_key.Precompute()
+		return private_key, nil
+	case *ecdsa.PublicKey:
+		d, err := decode(json_web_key.D)
+		if err != nil {
+			return nil, err
+		}
+		x, y := key.Curve.ScalarBaseMult(d.FillBytes(make([]byte, (key.Curve.Params().BitSize+7)/8)))
+		if x.Cmp(key.X) != 0 || y.Cmp(key.Y) != 0 {
+			return nil, errors.New("private key does not match public key")
+		}
+		return &ecdsa.PrivateKey{PublicKey: *key, D: d}, nil
+	case ed25519.PublicKey:
+		seed, err := base64.RawURLEncoding.DecodeString(json_web_key.D)
+		if err != nil {
+			return nil, err
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		private_key := ed25519.NewKeyFromSeed(seed)
+		if !key.Equal(private_key.Public()) {
+			return nil, errors.New("private key does not match public key")
+		}
+		return private_key, nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+// LoadKeyRing loads Config.App.Keys.Directory with LoadKeyRingFromDirectory
+// rules, decrypting encrypted keys with KeyPassphrase. The signing key is
+// Config.App.Keys.SigningKeyID using Config.App.Host.SigningAlgorithm.
+func LoadKeyRing(config types.Config) (*KeyRing, error) {
+	passphrase, err := KeyPassphrase(config)
+	if err != nil {
+		return nil, err
+	}
+	return loadKeyRingFromDirectory(config.App.Keys.Directory, config.App.Keys.SigningKeyID, config.App.Host.SigningAlgorithm, passphrase)
+}
+
+func loadKeyRingFromDirectory(path string, signing_key_id string, signing_algorithm string, passphrase []byte) (*KeyRing, error) {
+	directory_entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	key_ring := NewKeyRing()
+	var signing_key crypto.PrivateKey
+	for _, directory_entry := range directory_entries {
+		extension := filepath.Ext(directory_entry.Name())
+		if directory_entry.IsDir() || !key_file_extensions[extension] {
+			continue
+		}
+		entries, err := readKeyFile(filepath.Join(path, directory_entry.Name()), passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %s: %w", directory_entry.Name(), err)
+		}
+		for _, entry := range entries {
+			// The file name is the key id unless the JWK names one
+			if entry.key_id == "" {
+				if len(entries) > 1 {
+					return nil, fmt.Errorf("key set %s has a key without a kid", directory_entry.Name())
+				}
+				entry.key_id = strings.TrimSuffix(directory_entry.Name(), extension)
+			}
+			if entry.key_id == signing_key_id && entry.private_key != nil {
+				signing_key = entry.private_key
+				if signing_algorithm == "" {
+					signing_algorithm = entry.algorithm
+				}
+				continue
+			}
+			err = key_ring.AddVerificationKey(entry.key_id, entry.algorithm, entry.public_key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to add key %s: %w", entry.key_id, err)
+			}
+		}
+	}
+	if signing_key_id != "" {
+		if signing_key == nil {
+			return nil, fmt.Errorf("signing key %s not found", signing_key_id)
+		}
+		err = key_ring.AddSigningKey(signing_key_id, signing_algorithm, signing_key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key_ring, nil
+}
+
+// Replace swaps in the keys of other in one step, so concurrent GenerateJWT
+// and ValidateJWT calls see either the old keys or the new ones, never a mix.
+func (key_ring *KeyRing) Replace(other *KeyRing) {
+	other.mutex.RLock()
+	keys := make(map[string]ringKey, len(other.keys))
+	for key_id, key := range other.keys {
+		keys[key_id] = key
+	}
+	signing_key_id := other.signing_key_id
+	other.mutex.RUnlock()
+
+	key_ring.mutex.Lock()
+	defer key_ring.mutex.Unlock()
+	key_ring.keys = keys
+	key_ring.signing_key_id = signing_key_id
+}
+
+// KeyRingWatcher reloads the key directory when its files change. Changes are
+// detected by polling modification times, a reload that fails keeps the keys
+// that are already loaded.
+type KeyRingWatcher struct {
+	mutex              sync.Mutex
+	key_ring           *KeyRing
+	config             types.Config
+	fingerprint        string
+	failed_fingerprint string
+	stop               chan struct{}
+	done               chan struct{}
+}
+
+// WatchKeyRing polls every Config.App.Keys.ReloadIntervalMs until Stop is called.
+func WatchKeyRing(key_ring *KeyRing, config types.Config) (*KeyRingWatcher, error) {
+	fingerprint, err := keyDirectoryFingerprint(config)
+	if err != nil {
+		return nil, err
+	}
+	watcher := &KeyRingWatcher{
+		key_ring:    key_ring,
+		config:      config,
+		fingerprint: fingerprint,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	interval_ms := config.App.Keys.ReloadIntervalMs
+	if interval_ms <= 0 {
+		interval_ms = default_reload_interval_ms
+	}
+	go watcher.run(time.Duration(interval_ms) * time.Millisecond)
+	return watcher, nil
+}
+
+func (watcher *KeyRingWatcher) run(interval time.Duration) {
+	defer close(watcher.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-watcher.stop:
+			return
+		case <-ticker.C:
+			watcher.Reload()
+		}
+	}
+}
+
+// Reload reloads the keys if the directory changed since the last reload.
+func (watcher *KeyRingWatcher) Reload() {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	fingerprint, err := keyDirectoryFingerprint(watcher.config)
+	if err != nil {
+		log.Printf("failed to check keys: %s\n", err.Error())
+		return
+	}
+	if fingerprint == watcher.fingerprint || fingerprint == watcher.failed_fingerprint {
+		return
+	}
+	key_ring, err := LoadKeyRing(watcher.config)
+	if err != nil {
+		// Retried once the files change again, i.e. a half written key is finished
+		log.Printf("failed to reload keys, keeping current keys: %s\n", err.Error())
+		watcher.failed_fingerprint = fingerprint
+		return
+	}
+	watcher.key_ring.Replace(key_ring)
+	watcher.fingerprint = fingerprint
+	log.Printf("reloaded keys: %v\n", watcher.key_ring.KeyIDs())
+}
+
+func (watcher *KeyRingWatcher) Stop() {
+	close(watcher.stop)
+	<-watcher.done
+}
+
+func keyDirectoryFingerprint(config types.Config) (string, error) {
+	directory_entries, err := os.ReadDir(config.App.Keys.Directory)
+	if err != nil {
+		return "", err
+	}
+	paths := []string{}
+	for _, directory_entry := range directory_entries {
+		if !directory_entry.IsDir() && key_file_extensions[filepath.Ext(directory_entry.Name())] {
+			paths = append(paths, filepath.Join(config.App.Keys.Directory, directory_entry.Name()))
+		}
+	}
+	if config.App.Keys.PassphraseFile != "" {
+		paths = append(paths, config.App.Keys.PassphraseFile)
+	}
+	sort.Strings(paths)
+	fingerprint := strings.Builder{}
+	for _, path := range paths {
+		// os.Stat follows symlinks, i.e. Kubernetes secret volumes
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&fingerprint, "%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+	}
+	return fingerprint.String(), nil
+}
@@ -0,0 +1,353 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// KeyRing holds the key used to sign new tokens along with every public key
+// that is still allowed to verify tokens. Retiring keys stay on the ring until
+// the tokens they signed have expired so keys can be rolled without logging
+// anyone out. Every key is pinned to a single algorithm, a token is only
+// verified if its `alg` header matches the algorithm of the key named by `kid`.
+type KeyRing struct {
+	mutex          sync.RWMutex
+	signing_key_id string
+	keys           map[string]ringKey
+}
+
+type ringKey struct {
+	method      jwt.SigningMethod
+	private_key crypto.PrivateKey
+	public_key  crypto.PublicKey
+}
+
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+	// Private key parameters, only read from key files and never published
+	D  string `json:"d,omitempty"`
+	P  string `json:"p,omitempty"`
+	Q  string `json:"q,omitempty"`
+	DP string `json:"dp,omitempty"`
+	DQ string `json:"dq,omitempty"`
+	QI string `json:"qi,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{
+		keys: map[string]ringKey{},
+	}
+}
+
+// AddSigningKey adds the key and makes it the active key for GenerateJWT.
+// The previously active key remains available for verification. An empty
+// algorithm picks the default for the key type (RS256, ES256/384/512, EdDSA).
+func (key_ring *KeyRing) AddSigningKey(key_id string, algorithm string, private_key crypto.PrivateKey) error {
+	if private_key == nil {
+		return errors.New("missing private key")
+	}
+	public_key, err := publicKeyOf(private_key)
+	if err != nil {
+		return err
+	}
+	method, err := signingMethodForKey(algorithm, public_key)
+	if err != nil {
+		return err
+	}
+	if key_id == "" {
+		key_id, err = KeyID(public_key)
+		if err != nil {
+			return err
+		}
+	}
+	key_ring.mutex.Lock()
+	defer key_ring.mutex.Unlock()
+	key_ring.keys[key_id] = ringKey{
+		method:      method,
+		private_key: private_key,
+		public_key:  public_key,
+	}
+	key_ring.signing_key_id = key_id
+	return nil
+}
+
+// AddVerificationKey adds a key that is only used to verify tokens, i.e. a
+// retiring key or a key belonging to another issuer. The signing key can't be
+// replaced this way, add a new signing key before retiring the current one.
+func (key_ring *KeyRing) AddVerificationKey(key_id string, algorithm string, public_key crypto.PublicKey) error {
+	if public_key == nil {
+		return errors.New("missing public key")
+	}
+	method, err := signingMethodForKey(algorithm, public_key)
+	if err != nil {
+		return err
+	}
+	if key_id == "" {
+		key_id, err = KeyID(public_key)
+		if err != nil {
+			return err
+		}
+	}
+	key_ring.mutex.Lock()
+	defer key_ring.mutex.Unlock()
+	if key_id == key_ring.signing_key_id {
+		return fmt.Errorf("key %s is the signing key", key_id)
+	}
+	key_ring.keys[key_id] = ringKey{
+		method:     method,
+		public_key: public_key,
+	}
+	return nil
+}
+
+// RemoveKey drops a fully retired key, tokens signed with it will no longer validate.
+func (key_ring *KeyRing) RemoveKey(key_id string) {
+	key_ring.mutex.Lock()
+	defer key_ring.mutex.Unlock()
+	delete(key_ring.keys, key_id)
+	if key_ring.signing_key_id == key_id {
+		key_ring.signing_key_id = ""
+	}
+}
+
+func (key_ring *KeyRing) SigningKey() (string, jwt.SigningMethod, crypto.PrivateKey, error) {
+	key_ring.mutex.RLock()
+	defer key_ring.mutex.RUnlock()
+	key, ok := key_ring.keys[key_ring.signing_key_id]
+	if !ok || key.private_key == nil {
+		return "", nil, nil, errors.New("no signing key configured")
+	}
+	return key_ring.signing_key_id, key.method, key.private_key, nil
+}
+
+func (key_ring *KeyRing) VerificationKey(key_id string) (jwt.SigningMethod, crypto.PublicKey, error) {
+	key_ring.mutex.RLock()
+	defer key_ring.mutex.RUnlock()
+	if key_id == "" {
+		// Tokens minted before kid headers existed can only be matched when
+		// there is no ambiguity about which key signed them
+		if len(key_ring.keys) != 1 {
+			return nil, nil, errors.New("missing key id")
+		}
+		for _, key := range key_ring.keys {
+			return key.method, key.public_key, nil
+		}
+	}
+	key, ok := key_ring.keys[key_id]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown key id: %s", key_id)
+	}
+	return key.method, key.public_key, nil
+}
+
+func (key_ring *KeyRing) KeyIDs() []string {
+	key_ring.mutex.RLock()
+	defer key_ring.mutex.RUnlock()
+	key_ids := make([]string, 0, len(key_ring.keys))
+	for key_id := range key_ring.keys {
+		key_ids = append(key_ids, key_id)
+	}
+	return key_ids
+}
+
+// Algorithms lists the distinct algorithms of the keys on the ring.
+func (key_ring *KeyRing) Algorithms() []string {
+	key_ring.mutex.RLock()
+	defer key_ring.mutex.RUnlock()
+	seen := map[string]bool{}
+	algorithms := []string{}
+	for _, key := range key_ring.keys {
+		if !seen[key.method.Alg()] {
+			seen[key.method.Alg()] = true
+			algorithms = append(algorithms, key.method.Alg())
+		}
+	}
+	return algorithms
+}
+
+// KeyID derives a stable key id from the RFC 7638 thumbprint of the key.
+func KeyID(public_key crypto.PublicKey) (string, error) {
+	json_web_key, err := newJSONWebKey("", nil, public_key)
+	if err != nil {
+		return "", err
+	}
+	var thumbprint_input string
+	switch json_web_key.KeyType {
+	case "RSA":
+		thumbprint_input = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, json_web_key.E, json_web_key.N)
+	case "EC":
+		thumbprint_input = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, json_web_key.Curve, json_web_key.X, json_web_key.Y)
+	case "OKP":
+		thumbprint_input = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, json_web_key.Curve, json_web_key.X)
+	}
+	sum := sha256.Sum256([]byte(thumbprint_input))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// LoadKeyRingFromDirectory loads every key file (*.pem, *.key, *.jwk, *.json)
+// in the directory, the file name (minus the extension) is used as the key id
+// unless a JWK names its own. Private keys are added for verification as
+// well, signing_key_id selects which one signs new tokens and may be empty for
+// services that only validate tokens. The signing key uses signing_algorithm,
+// the remaining keys use their JWK `alg` or the default for their key type.
+// Use LoadKeyRing for encrypted keys.
+func LoadKeyRingFromDirectory(path string, signing_key_id string, signing_algorithm string) (*KeyRing, error) {
+	return loadKeyRingFromDirectory(path, signing_key_id, signing_algorithm, nil)
+}
+
+// LoadKeyRingFromJWKS loads the public keys from a JWKS json file. The
+// resulting ring can only verify tokens.
+func LoadKeyRingFromJWKS(path string) (*KeyRing, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var key_set JSONWebKeySet
+	err = json.Unmarshal(bytes, &key_set)
+	if err != nil {
+		return nil, err
+	}
+	key_ring := NewKeyRing()
+	for _, json_web_key := range key_set.Keys {
+		if json_web_key.Use != "" && json_web_key.Use != "sig" {
+			continue
+		}
+		public_key, err := json_web_key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %s: %w", json_web_key.KeyID, err)
+		}
+		err = key_ring.AddVerificationKey(json_web_key.KeyID, json_web_key.Algorithm, public_key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add key %s: %w", json_web_key.KeyID, err)
+		}
+	}
+	return key_ring, nil
+}
+
+// JWKS returns the public half of every key on the ring.
+func (key_ring *KeyRing) JWKS() JSONWebKeySet {
+	key_ring.mutex.RLock()
+	defer key_ring.mutex.RUnlock()
+	key_set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for key_id, key := range key_ring.keys {
+		json_web_key, err := newJSONWebKey(key_id, key.method, key.public_key)
+		if err != nil {
+			continue
+		}
+		key_set.Keys = append(key_set.Keys, json_web_key)
+	}
+	return key_set
+}
+
+func newJSONWebKey(key_id string, method jwt.SigningMethod, public_key crypto.PublicKey) (JSONWebKey, error) {
+	json_web_key := JSONWebKey{
+		KeyID: key_id,
+	}
+	if method != nil {
+		json_web_key.Use = "sig"
+		json_web_key.Algorithm = method.Alg()
+	}
+	switch key := public_key.(type) {
+	case *rsa.PublicKey:
+		json_web_key.KeyType = "RSA"
+		json_web_key.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		json_web_key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		json_web_key.KeyType = "EC"
+		json_web_key.Curve = key.Curve.Params().Name
+		json_web_key.X = base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size)))
+		json_web_key.Y = base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		json_web_key.KeyType = "OKP"
+		json_web_key.Curve = "Ed25519"
+		json_web_key.X = base64.RawURLEncoding.EncodeToString(key)
+	default:
+		return json_web_key, errors.New("unsupported key type")
+	}
+	return json_web_key, nil
+}
+
+func (json_web_key JSONWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		bytes, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes) == 0 {
+			return nil, errors.New("missing key parameter")
+		}
+		return new(big.Int).SetBytes(bytes), nil
+	}
+	switch json_web_key.KeyType {
+	case "RSA":
+		n, err := decode(json_web_key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(json_web_key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(),
+			"P-521": elliptic.P521(),
+		}[json_web_key.Curve]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve: %s", json_web_key.Curve)
+		}
+		x, err := decode(json_web_key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(json_web_key.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if json_web_key.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", json_web_key.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(json_web_key.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", json_web_key.KeyType)
+}
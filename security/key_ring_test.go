@@ -0,0 +1,42 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func TestAddVerificationKeyKeepsTheSigningKey(t *testing.T) {
+	private_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_ring := NewKeyRing()
+	err = key_ring.AddSigningKey("current", "", private_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = key_ring.AddVerificationKey("current", "", &private_key.PublicKey)
+	if err == nil {
+		t.Fatal("expected the signing key id to be rejected")
+	}
+	_, _, _, err = key_ring.SigningKey()
+	if err != nil {
+		t.Fatalf("the signing key must still sign, got %v", err)
+	}
+
+	// Once another key signs, the old one can be kept for verification only
+	other_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = key_ring.AddSigningKey("next", "", other_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = key_ring.AddVerificationKey("current", "", &private_key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,84 @@
+package security
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginAttemptStore counts failed logins per account so repeated guessing
+// locks the account for Config.App.Lockout.DurationMs.
+type LoginAttemptStore interface {
+	// RecordFailure returns the failures in a row, the count starts over when
+	// the previous failure is older than window
+	RecordFailure(account string, window time.Duration) (int, error)
+	Lock(account string, until time.Time) error
+	LockedUntil(account string) (time.Time, error)
+	Reset(account string) error
+}
+
+type MemoryLoginAttemptStore struct {
+	mutex    sync.Mutex
+	failures map[string]loginFailures
+	locks    map[string]time.Time
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{
+		failures: map[string]loginFailures{},
+		locks:    map[string]time.Time{},
+	}
+}
+
+func (store *MemoryLoginAttemptStore) RecordFailure(account string, window time.Duration) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	account = strings.ToLower(account)
+	now := time.Now().UTC()
+	failures := store.failures[account]
+	if now.Sub(failures.last) > window {
+		failures.count = 0
+	}
+	failures.count++
+	failures.last = now
+	store.failures[account] = failures
+	return failures.count, nil
+}
+
+func (store *MemoryLoginAttemptStore) Lock(account string, until time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	account = strings.ToLower(account)
+	store.locks[account] = until
+	delete(store.failures, account)
+	return nil
+}
+
+func (store *MemoryLoginAttemptStore) LockedUntil(account string) (time.Time, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	account = strings.ToLower(account)
+	until, ok := store.locks[account]
+	if !ok {
+		return time.Time{}, nil
+	}
+	if until.Before(time.Now().UTC()) {
+		delete(store.locks, account)
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+func (store *MemoryLoginAttemptStore) Reset(account string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	account = strings.ToLower(account)
+	delete(store.failures, account)
+	delete(store.locks, account)
+	return nil
+}
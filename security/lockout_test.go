@@ -0,0 +1,35 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginAttemptFailureWindow(t *testing.T) {
+	store := NewMemoryLoginAttemptStore()
+	window := 50 * time.Millisecond
+	for i := 1; i <= 2; i++ {
+		failures, err := store.RecordFailure("user:a", window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures != i {
+			t.Fatalf("expected %d failures, got %d", i, failures)
+		}
+	}
+	// Accounts are counted separately and ignoring case
+	failures, _ := store.RecordFailure("USER:A", window)
+	if failures != 3 {
+		t.Fatalf("expected the count to ignore case, got %d", failures)
+	}
+	failures, _ = store.RecordFailure("user:b", window)
+	if failures != 1 {
+		t.Fatalf("expected another account to start at 1, got %d", failures)
+	}
+
+	time.Sleep(2 * window)
+	failures, _ = store.RecordFailure("user:a", window)
+	if failures != 1 {
+		t.Fatalf("expected an old failure to be forgotten, got %d", failures)
+	}
+}
@@ -0,0 +1,154 @@
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/AuthenticationMethod"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+	"github.com/thedanisaur/jfl_platform/types/MutualTLSMode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+var ErrNoClientCertificate = types.NewPlatformError(ErrorKind.Unauthenticated, "missing_client_certificate", "no client certificate")
+
+func LoadClientCAs(path string) (*x509.CertPool, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bytes) {
+		return nil, errors.New("no certificates found in client ca bundle")
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig builds the listener config for Config.App.Host, requesting
+// client certificates when Config.App.MutualTLS is enabled.
+func ServerTLSConfig(config types.Config) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(config.App.Host.CertificatePath, config.App.Host.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	tls_config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch config.App.MutualTLS.Mode {
+	case MutualTLSMode.Disabled:
+		return tls_config, nil
+	case MutualTLSMode.Certificate, MutualTLSMode.CertificateAndJWT:
+		tls_config.ClientAuth = tls.RequireAndVerifyClientCert
+	case MutualTLSMode.CertificateOrJWT:
+		tls_config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unsupported mutual tls mode: %s", config.App.MutualTLS.Mode)
+	}
+	tls_config.ClientCAs, err = LoadClientCAs(config.App.MutualTLS.ClientCAPath)
+	if err != nil {
+		return nil, err
+	}
+	return tls_config, nil
+}
+
+// ValidateClientCertificate verifies the peer certificate against the client
+// CA bundle, even if the listener already did, and maps it to UserClaims.
+// ErrNoClientCertificate is returned when the client didn't present one.
+func ValidateClientCertificate(txid uuid.UUID, c *fiber.Ctx, config types.Config, client_cas *x509.CertPool) (types.UserClaims, error) {
+	connection_state := c.Context().TLSConnectionState()
+	if connection_state == nil || len(connection_state.PeerCertificates) == 0 {
+		return types.UserClaims{}, ErrNoClientCertificate
+	}
+	if client_cas == nil {
+		return types.UserClaims{}, errors.New("no client ca bundle configured")
+	}
+	certificate := connection_state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range connection_state.PeerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+	_, err := certificate.Verify(x509.VerifyOptions{
+		Roots:         client_cas,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		log.Printf("%s | client certificate rejected: %s\n", txid.String(), err.Error())
+		return types.UserClaims{}, ErrInvalidClientCertificate
+	}
+	return MapCertificateToUserClaims(txid, certificate, config)
+}
+
+func MapCertificateToUserClaims(txid uuid.UUID, certificate *x509.Certificate, config types.Config) (types.UserClaims, error) {
+	user_claims := types.UserClaims{
+		AuthenticationMethods: []string{AuthenticationMethod.SoftwareKey},
+	}
+
+	user_id_string, err := certificateField(certificate, config.App.MutualTLS.Mapping["user_id"])
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return user_claims, ErrInvalidClientCertificate
+	}
+	user_id, err := uuid.Parse(strings.TrimPrefix(user_id_string, "urn:uuid:"))
+	if err != nil {
+		log.Printf("%s | certificate user id is not a uuid\n", txid.String())
+		return user_claims, ErrInvalidClientCertificate
+	}
+	user_claims.UserID = user_id
+	user_claims.IssuingUnit, err = certificateField(certificate, config.App.MutualTLS.Mapping["issuing_unit"])
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return user_claims, ErrInvalidClientCertificate
+	}
+	user_claims.RoleName, err = certificateField(certificate, config.App.MutualTLS.Mapping["role_name"])
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return user_claims, ErrInvalidClientCertificate
+	}
+
+	return user_claims, nil
+}
+
+func certificateField(certificate *x509.Certificate, field string) (string, error) {
+	first := func(values []string) (string, error) {
+		if len(values) == 0 || values[0] == "" {
+			return "", fmt.Errorf("certificate is missing %s", field)
+		}
+		return values[0], nil
+	}
+	if strings.HasPrefix(field, "literal:") {
+		return strings.TrimPrefix(field, "literal:"), nil
+	}
+	switch field {
+	case "subject_cn":
+		return first([]string{certificate.Subject.CommonName})
+	case "subject_ou":
+		return first(certificate.Subject.OrganizationalUnit)
+	case "subject_o":
+		return first(certificate.Subject.Organization)
+	case "subject_serial":
+		return first([]string{certificate.Subject.SerialNumber})
+	case "san_email":
+		return first(certificate.EmailAddresses)
+	case "san_dns":
+		return first(certificate.DNSNames)
+	case "san_uri":
+		uris := []string{}
+		for _, uri := range certificate.URIs {
+			uris = append(uris, uri.String())
+		}
+		return first(uris)
+	case "":
+		return "", errors.New("certificate mapping not configured")
+	}
+	return "", fmt.Errorf("unsupported certificate field: %s", field)
+}
@@ -0,0 +1,264 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// testCA issues client and server certificates for the mutual TLS tests.
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pool        *x509.CertPool
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return testCA{certificate: certificate, key: key, pool: pool}
+}
+
+// issue signs template, the validity and key usage are filled in.
+func (ca testCA) issue(t *testing.T, template *x509.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// testTLSClient serves handler over TLS, asking for but not verifying client
+// certificates so the handler sees whatever the client presented, and returns
+// a client that presents certificates.
+func testTLSClient(t *testing.T, server_ca testCA, handler fiber.Handler, certificates ...tls.Certificate) (*http.Client, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_certificate := server_ca.issue(t, &x509.Certificate{IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}}, x509.ExtKeyUsageServerAuth)
+	tls_listener := tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{server_certificate},
+		ClientAuth:   tls.RequestClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.All("/*", handler)
+	go app.Listener(tls_listener)
+	t.Cleanup(func() {
+		app.Shutdown()
+	})
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      server_ca.pool,
+				Certificates: certificates,
+				MinVersion:   tls.VersionTLS12,
+			},
+		},
+	}
+	return client, "https://" + listener.Addr().String() + "/"
+}
+
+func testTLSGet(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+	response, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, string(body)
+}
+
+func testMappingConfig() map[string]string {
+	return map[string]string{
+		"user_id":      "subject_cn",
+		"issuing_unit": "subject_ou",
+		"role_name":    "literal:pilot",
+	}
+}
+
+func TestValidateClientCertificate(t *testing.T) {
+	client_ca := newTestCA(t, "clients")
+	other_ca := newTestCA(t, "other")
+	user_id := uuid.New()
+	config := testConfig()
+	config.App.MutualTLS.Mapping = testMappingConfig()
+	handler := func(c *fiber.Ctx) error {
+		user_claims, err := ValidateClientCertificate(uuid.New(), c, config, client_ca.pool)
+		if errors.Is(err, ErrNoClientCertificate) {
+			return c.Status(fiber.StatusUnauthorized).SendString("missing")
+		}
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).SendString("invalid")
+		}
+		return c.SendString(user_claims.UserID.String() + " " + user_claims.IssuingUnit + " " + user_claims.RoleName)
+	}
+	subject := pkix.Name{CommonName: user_id.String(), OrganizationalUnit: []string{"unit"}}
+
+	tests := []struct {
+		name         string
+		certificates []tls.Certificate
+		status       int
+		body         string
+	}{
+		{"chained to the client ca", []tls.Certificate{client_ca.issue(t, &x509.Certificate{Subject: subject}, x509.ExtKeyUsageClientAuth)}, fiber.StatusOK, user_id.String() + " unit pilot"},
+		{"other ca", []tls.Certificate{other_ca.issue(t, &x509.Certificate{Subject: subject}, x509.ExtKeyUsageClientAuth)}, fiber.StatusUnauthorized, "invalid"},
+		{"server certificate", []tls.Certificate{client_ca.issue(t, &x509.Certificate{Subject: subject}, x509.ExtKeyUsageServerAuth)}, fiber.StatusUnauthorized, "invalid"},
+		{"no certificate", nil, fiber.StatusUnauthorized, "missing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, url := testTLSClient(t, client_ca, handler, test.certificates...)
+			status, body := testTLSGet(t, client, url)
+			if status != test.status || body != test.body {
+				t.Fatalf("expected %d %q, got %d %q", test.status, test.body, status, body)
+			}
+		})
+	}
+}
+
+func TestCertificateField(t *testing.T) {
+	uri, err := url.Parse("urn:uuid:" + uuid.NewString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "common name",
+			OrganizationalUnit: []string{"unit", "other unit"},
+			Organization:       []string{"organization"},
+			SerialNumber:       "serial",
+		},
+		EmailAddresses: []string{"pilot@jfl.test"},
+		DNSNames:       []string{"pilot.jfl.test"},
+		URIs:           []*url.URL{uri},
+	}
+	tests := []struct {
+		field string
+		value string
+		ok    bool
+	}{
+		{"subject_cn", "common name", true},
+		{"subject_ou", "unit", true},
+		{"subject_o", "organization", true},
+		{"subject_serial", "serial", true},
+		{"san_email", "pilot@jfl.test", true},
+		{"san_dns", "pilot.jfl.test", true},
+		{"san_uri", uri.String(), true},
+		{"literal:pilot", "pilot", true},
+		{"literal:", "", true},
+		{"", "", false},
+		{"subject_c", "", false},
+	}
+	for _, test := range tests {
+		value, err := certificateField(certificate, test.field)
+		if (err == nil) != test.ok || value != test.value {
+			t.Fatalf("%q: expected %q %v, got %q %v", test.field, test.value, test.ok, value, err)
+		}
+	}
+	// A field the certificate doesn't have is an error rather than empty
+	_, err = certificateField(&x509.Certificate{}, "san_email")
+	if err == nil {
+		t.Fatal("expected a missing field to fail")
+	}
+}
+
+func TestMapCertificateToUserClaims(t *testing.T) {
+	user_id := uuid.New()
+	config := testConfig()
+	config.App.MutualTLS.Mapping = map[string]string{
+		"user_id":      "san_uri",
+		"issuing_unit": "literal:unit",
+		"role_name":    "subject_o",
+	}
+	uri, err := url.Parse("urn:uuid:" + user_id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := &x509.Certificate{
+		Subject: pkix.Name{Organization: []string{"instructor"}},
+		URIs:    []*url.URL{uri},
+	}
+	user_claims, err := MapCertificateToUserClaims(uuid.New(), certificate, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user_claims.UserID != user_id || user_claims.IssuingUnit != "unit" || user_claims.RoleName != "instructor" {
+		t.Fatalf("unexpected claims %+v", user_claims)
+	}
+
+	// The user id has to be a uuid
+	config.App.MutualTLS.Mapping["user_id"] = "literal:pilot"
+	_, err = MapCertificateToUserClaims(uuid.New(), certificate, config)
+	if !errors.Is(err, ErrInvalidClientCertificate) {
+		t.Fatalf("expected ErrInvalidClientCertificate, got %v", err)
+	}
+	// Every claim has to be mapped
+	delete(config.App.MutualTLS.Mapping, "role_name")
+	config.App.MutualTLS.Mapping["user_id"] = "san_uri"
+	_, err = MapCertificateToUserClaims(uuid.New(), certificate, config)
+	if !errors.Is(err, ErrInvalidClientCertificate) {
+		t.Fatalf("expected ErrInvalidClientCertificate, got %v", err)
+	}
+}
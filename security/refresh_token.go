@@ -0,0 +1,227 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+
+	"github.com/google/uuid"
+)
+
+var ErrRefreshTokenNotFound = types.NewPlatformError(ErrorKind.NotFound, "refresh_token_not_found", "refresh token not found")
+var ErrRefreshTokenReused = types.NewPlatformError(ErrorKind.Unauthenticated, "refresh_token_reused", "refresh token reused")
+
+// RefreshToken is the server side record of an opaque refresh token. Only the
+// hash of the token is stored, every token minted by rotating a refresh token
+// shares the FamilyID of the token it replaced.
+type RefreshToken struct {
+	TokenHash  string
+	FamilyID   uuid.UUID
+	UserClaims types.UserClaims
+	IssuedAt   time.Time
+	ExpiresAt  time.Time
+	Used       bool
+	Revoked    bool
+}
+
+type RefreshTokenStore interface {
+	Save(refresh_token RefreshToken) error
+	// Consume marks the token as used and returns the record as it was before
+	// it was consumed, implementations must do this atomically so that two
+	// concurrent requests can't both rotate the same token.
+	Consume(token_hash string) (RefreshToken, error)
+	RevokeFamily(family_id uuid.UUID) error
+	RevokeUser(user_id uuid.UUID) error
+}
+
+type MemoryRefreshTokenStore struct {
+	mutex  sync.Mutex
+	tokens map[string]RefreshToken
+}
+
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{
+		tokens: map[string]RefreshToken{},
+	}
+}
+
+func (store *MemoryRefreshTokenStore) Save(refresh_token RefreshToken) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.tokens[refresh_token.TokenHash] = refresh_token
+	return nil
+}
+
+func (store *MemoryRefreshTokenStore) Consume(token_hash string) (RefreshToken, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	refresh_token, ok := store.tokens[token_hash]
+	if !ok {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	updated_token := refresh_token
+	updated_token.Used = true
+	store.tokens[token_hash] = updated_token
+	return refresh_token, nil
+}
+
+func (store *MemoryRefreshTokenStore) RevokeFamily(family_id uuid.UUID) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for token_hash, refresh_token := range store.tokens {
+		if refresh_token.FamilyID == family_id {
+			refresh_token.Revoked = true
+			store.tokens[token_hash] = refresh_token
+		}
+	}
+	return nil
+}
+
+func (store *MemoryRefreshTokenStore) RevokeUser(user_id uuid.UUID) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for token_hash, refresh_token := range store.tokens {
+		if refresh_token.UserClaims.UserID == user_id {
+			refresh_token.Revoked = true
+			store.tokens[token_hash] = refresh_token
+		}
+	}
+	return nil
+}
+
+// Purge removes tokens that expired before the cutoff.
+func (store *MemoryRefreshTokenStore) Purge(cutoff time.Time) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for token_hash, refresh_token := range store.tokens {
+		if refresh_token.ExpiresAt.Before(cutoff) {
+			delete(store.tokens, token_hash)
+		}
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateOpaqueToken() (string, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+func GenerateRefreshToken(txid uuid.UUID, user_claims types.UserClaims, expires_at time.Time, store RefreshTokenStore) (string, error) {
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	err = store.Save(RefreshToken{
+		TokenHash:  hashToken(token),
+		FamilyID:   user_claims.SessionID,
+		UserClaims: user_claims,
+		IssuedAt:   time.Now().UTC(),
+		ExpiresAt:  expires_at,
+	})
+	if err != nil {
+		log.Printf("%s | failed to save refresh token: %s\n", txid.String(), err.Error())
+		return "", errors.New("failed to save refresh token")
+	}
+	return token, nil
+}
+
+// GenerateTokenPair mints an access token and starts a new refresh token
+// family. The family is the session, it is identified by user_claims.SessionID
+// (a new one is assigned when it isn't set) and lasts for RefreshExpirationMs
+// no matter how many times it is rotated.
+func GenerateTokenPair(txid uuid.UUID, user_claims types.UserClaims, config types.Config, key_ring *KeyRing, store RefreshTokenStore) (types.TokenResponse, error) {
+	if user_claims.SessionID == uuid.Nil {
+		user_claims.SessionID = uuid.New()
+	}
+	expires_at := time.Now().UTC().Add(time.Duration(config.App.RefreshExpirationMs) * time.Millisecond)
+	return generateTokenPair(txid, user_claims, expires_at, config, key_ring, store)
+}
+
+func generateTokenPair(txid uuid.UUID, user_claims types.UserClaims, expires_at time.Time, config types.Config, key_ring *KeyRing, store RefreshTokenStore) (types.TokenResponse, error) {
+	access_token, err := GenerateJWT(txid, user_claims, config, key_ring)
+	if err != nil {
+		return types.TokenResponse{}, err
+	}
+	refresh_token, err := GenerateRefreshToken(txid, user_claims, expires_at, store)
+	if err != nil {
+		return types.TokenResponse{}, err
+	}
+	return types.TokenResponse{
+		AccessToken:  access_token,
+		TokenType:    "Bearer",
+		ExpiresIn:    config.App.LoginExpirationMs / 1000,
+		RefreshToken: refresh_token,
+	}, nil
+}
+
+// familyRevoker ends a refresh token family, SessionRegistry also ends the
+// session the family belongs to.
+type familyRevoker func(txid uuid.UUID, refresh_token RefreshToken) error
+
+func revokeFamily(store RefreshTokenStore) familyRevoker {
+	return func(txid uuid.UUID, refresh_token RefreshToken) error {
+		return store.RevokeFamily(refresh_token.FamilyID)
+	}
+}
+
+// RotateRefreshToken exchanges a refresh token for a new token pair. Refresh
+// tokens are single use, presenting one a second time means it was stolen so
+// the whole family is revoked and both parties have to log in again. Use
+// SessionRegistry.RotateRefreshToken when sessions are registered.
+func RotateRefreshToken(txid uuid.UUID, token string, config types.Config, key_ring *KeyRing, store RefreshTokenStore) (types.TokenResponse, error) {
+	return rotateRefreshToken(txid, token, config, key_ring, store, revokeFamily(store))
+}
+
+func rotateRefreshToken(txid uuid.UUID, token string, config types.Config, key_ring *KeyRing, store RefreshTokenStore, revoke familyRevoker) (types.TokenResponse, error) {
+	refresh_token, err := store.Consume(hashToken(token))
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return types.TokenResponse{}, ErrInvalidRefreshToken
+	}
+	if refresh_token.Used {
+		log.Printf("%s | refresh token reuse detected, revoking family %s\n", txid.String(), refresh_token.FamilyID.String())
+		err = revoke(txid, refresh_token)
+		if err != nil {
+			log.Printf("%s | failed to revoke family: %s\n", txid.String(), err.Error())
+		}
+		return types.TokenResponse{}, ErrRefreshTokenReused
+	}
+	if refresh_token.Revoked {
+		return types.TokenResponse{}, ErrInvalidRefreshToken.Wrap(errors.New("refresh token revoked"))
+	}
+	if time.Now().UTC().After(refresh_token.ExpiresAt) {
+		return types.TokenResponse{}, ErrRefreshTokenExpired
+	}
+	return generateTokenPair(txid, refresh_token.UserClaims, refresh_token.ExpiresAt, config, key_ring, store)
+}
+
+// RevokeRefreshToken ends the family the token belongs to, i.e. on logout. Use
+// SessionRegistry.RevokeRefreshToken when sessions are registered.
+func RevokeRefreshToken(txid uuid.UUID, token string, store RefreshTokenStore) error {
+	return revokeRefreshToken(txid, token, store, revokeFamily(store))
+}
+
+func revokeRefreshToken(txid uuid.UUID, token string, store RefreshTokenStore, revoke familyRevoker) error {
+	refresh_token, err := store.Consume(hashToken(token))
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return ErrInvalidRefreshToken
+	}
+	return revoke(txid, refresh_token)
+}
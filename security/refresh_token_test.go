@@ -0,0 +1,133 @@
+package security
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRotateRefreshTokenFamily(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	config.App.RefreshExpirationMs = 3600000
+	store := NewMemoryRefreshTokenStore()
+	user_claims := testUserClaims()
+
+	first, err := GenerateTokenPair(uuid.New(), user_claims, config, key_ring, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.tokens[first.RefreshToken]; ok {
+		t.Fatal("the refresh token must only be stored hashed")
+	}
+	first_record := store.tokens[hashToken(first.RefreshToken)]
+	if first_record.FamilyID == uuid.Nil || first_record.FamilyID != first_record.UserClaims.SessionID {
+		t.Fatalf("the family should be the session, got %s", first_record.FamilyID)
+	}
+
+	second, err := RotateRefreshToken(uuid.New(), first.RefreshToken, config, key_ring, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == "" {
+		t.Fatal("rotation should mint a new token pair")
+	}
+	second_record := store.tokens[hashToken(second.RefreshToken)]
+	if second_record.FamilyID != first_record.FamilyID {
+		t.Fatalf("rotation should stay in family %s, got %s", first_record.FamilyID, second_record.FamilyID)
+	}
+	if !second_record.ExpiresAt.Equal(first_record.ExpiresAt) {
+		t.Fatal("rotation must not extend the family")
+	}
+
+	// Replaying the first token revokes the family, the legitimate holder of
+	// the second token has to log in again too
+	_, err = RotateRefreshToken(uuid.New(), first.RefreshToken, config, key_ring, store)
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	_, err = RotateRefreshToken(uuid.New(), second.RefreshToken, config, key_ring, store)
+	if !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("expected the family to be revoked, got %v", err)
+	}
+
+	// Other families of the user are left alone
+	other, err := GenerateTokenPair(uuid.New(), user_claims, config, key_ring, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RotateRefreshToken(uuid.New(), other.RefreshToken, config, key_ring, store)
+	if err != nil {
+		t.Fatalf("another session should still rotate, got %v", err)
+	}
+}
+
+func TestRotateRefreshTokenRejects(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	store := NewMemoryRefreshTokenStore()
+
+	_, err := RotateRefreshToken(uuid.New(), "unknown", config, key_ring, store)
+	if !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("expected ErrInvalidRefreshToken for an unknown token, got %v", err)
+	}
+
+	expired, err := GenerateRefreshToken(uuid.New(), testUserClaims(), time.Now().UTC().Add(-time.Minute), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RotateRefreshToken(uuid.New(), expired, config, key_ring, store)
+	if !errors.Is(err, ErrRefreshTokenExpired) {
+		t.Fatalf("expected ErrRefreshTokenExpired, got %v", err)
+	}
+
+	logged_out, err := GenerateRefreshToken(uuid.New(), testUserClaims(), time.Now().UTC().Add(time.Hour), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RevokeRefreshToken(uuid.New(), logged_out, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RotateRefreshToken(uuid.New(), logged_out, config, key_ring, store)
+	if err == nil {
+		t.Fatal("a logged out token must not rotate")
+	}
+}
+
+func TestRotateRefreshTokenConcurrently(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	store := NewMemoryRefreshTokenStore()
+	token, err := GenerateRefreshToken(uuid.New(), testUserClaims(), time.Now().UTC().Add(time.Hour), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan error, 8)
+	var wait_group sync.WaitGroup
+	for i := 0; i < cap(results); i++ {
+		wait_group.Add(1)
+		go func() {
+			defer wait_group.Done()
+			_, err := RotateRefreshToken(uuid.New(), token, config, key_ring, store)
+			results <- err
+		}()
+	}
+	wait_group.Wait()
+	close(results)
+	rotated := 0
+	for err := range results {
+		if err == nil {
+			rotated++
+		} else if !errors.Is(err, ErrRefreshTokenReused) {
+			t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+		}
+	}
+	if rotated != 1 {
+		t.Fatalf("exactly one request may rotate the token, %d did", rotated)
+	}
+}
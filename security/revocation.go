@@ -0,0 +1,201 @@
+package security
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+// RevocationStore is the jti denylist consulted by ValidateJWT. Besides single
+// tokens it tracks a per user cutoff so every token issued to a user before a
+// point in time can be revoked at once, i.e. on password change or suspension.
+type RevocationStore interface {
+	RevokeToken(jti string, expires_at time.Time) error
+	RevokeUser(user_id uuid.UUID, issued_before time.Time) error
+	IsRevoked(jti string, user_id uuid.UUID, issued_at time.Time) (bool, error)
+}
+
+type MemoryRevocationStore struct {
+	mutex          sync.RWMutex
+	revoked_tokens map[string]time.Time
+	revoked_users  map[uuid.UUID]time.Time
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		revoked_tokens: map[string]time.Time{},
+		revoked_users:  map[uuid.UUID]time.Time{},
+	}
+}
+
+func (store *MemoryRevocationStore) RevokeToken(jti string, expires_at time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.revoked_tokens[jti] = expires_at
+	return nil
+}
+
+func (store *MemoryRevocationStore) RevokeUser(user_id uuid.UUID, issued_before time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if current, ok := store.revoked_users[user_id]; ok && current.After(issued_before) {
+		return nil
+	}
+	store.revoked_users[user_id] = issued_before
+	return nil
+}
+
+func (store *MemoryRevocationStore) IsRevoked(jti string, user_id uuid.UUID, issued_at time.Time) (bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if _, ok := store.revoked_tokens[jti]; ok {
+		return true, nil
+	}
+	if issued_before, ok := store.revoked_users[user_id]; ok && issued_at.UnixMilli() < issued_before.UnixMilli() {
+		return true, nil
+	}
+	return false, nil
+}
+
+// Purge drops revoked tokens that would have expired anyway.
+func (store *MemoryRevocationStore) Purge(cutoff time.Time) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for jti, expires_at := range store.revoked_tokens {
+		if expires_at.Before(cutoff) {
+			delete(store.revoked_tokens, jti)
+		}
+	}
+}
+
+const RevocationSchema = `
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	jti VARCHAR(64) NOT NULL PRIMARY KEY,
+	expires_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS revoked_users (
+	user_id BINARY(16) NOT NULL PRIMARY KEY,
+	revoked_before DATETIME(3) NOT NULL
+);`
+
+type SQLRevocationStore struct {
+	db *sql.DB
+}
+
+func NewSQLRevocationStore(db *sql.DB) *SQLRevocationStore {
+	return &SQLRevocationStore{db: db}
+}
+
+func (store *SQLRevocationStore) RevokeToken(jti string, expires_at time.Time) error {
+	_, err := store.db.Exec(`
+		INSERT INTO revoked_tokens (jti, expires_at)
+		VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE expires_at = VALUES(expires_at)`,
+		jti, expires_at.UTC(),
+	)
+	return err
+}
+
+func (store *SQLRevocationStore) RevokeUser(user_id uuid.UUID, issued_before time.Time) error {
+	_, err := store.db.Exec(`
+		INSERT INTO revoked_users (user_id, revoked_before)
+		VALUES (UUID_TO_BIN(?), ?)
+		ON DUPLICATE KEY UPDATE revoked_before = GREATEST(revoked_before, VALUES(revoked_before))`,
+		user_id, issued_before.UTC().Truncate(time.Millisecond),
+	)
+	return err
+}
+
+func (store *SQLRevocationStore) IsRevoked(jti string, user_id uuid.UUID, issued_at time.Time) (bool, error) {
+	var revoked bool
+	err := store.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?)
+		OR EXISTS (SELECT 1 FROM revoked_users WHERE user_id = UUID_TO_BIN(?) AND revoked_before > ?)`,
+		jti, user_id, issued_at.UTC().Truncate(time.Millisecond),
+	).Scan(&revoked)
+	if err != nil {
+		return false, err
+	}
+	return revoked, nil
+}
+
+// Purge drops revoked tokens that would have expired anyway.
+func (store *SQLRevocationStore) Purge(cutoff time.Time) error {
+	_, err := store.db.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", cutoff.UTC())
+	return err
+}
+
+func RevokeJWT(txid uuid.UUID, jti string, expires_at time.Time, store RevocationStore) error {
+	log.Printf("%s | revoking token %s\n", txid.String(), jti)
+	return store.RevokeToken(jti, expires_at)
+}
+
+// RevokeToken revokes a raw token, i.e. the bearer token presented on logout.
+func RevokeToken(txid uuid.UUID, token string, key_ring *KeyRing, store RevocationStore) error {
+	claims, err := parseToken(token, key_ring)
+	if err != nil {
+		return err
+	}
+	jti, ok := claims["jti"].(string)
+	if !ok {
+		return errors.New("missing jti")
+	}
+	expires_at := time.Now().UTC()
+	if exp, ok := claims["exp"].(float64); ok {
+		expires_at = time.Unix(int64(exp), 0).UTC()
+	}
+	return RevokeJWT(txid, jti, expires_at, store)
+}
+
+// RevokeUserTokens revokes every token issued to the user before issued_before,
+// compared to the millisecond so a login right after it isn't revoked too.
+func RevokeUserTokens(txid uuid.UUID, user_id uuid.UUID, issued_before time.Time, store RevocationStore) error {
+	log.Printf("%s | revoking tokens for user %s issued before %s\n", txid.String(), user_id.String(), issued_before.UTC().Format(time.RFC3339))
+	return store.RevokeUser(user_id, issued_before)
+}
+
+// issuedAt keeps millisecond precision in iat, a NumericDate may be fractional,
+// so tokens issued in the same second as a per user revocation can be told apart.
+func issuedAt(now time.Time) float64 {
+	return float64(now.UnixMilli()) / 1000
+}
+
+func issuedAtTime(iat float64) time.Time {
+	return time.UnixMilli(int64(math.Round(iat * 1000))).UTC()
+}
+
+func checkRevocation(txid uuid.UUID, claims jwt.MapClaims, user_id uuid.UUID, store RevocationStore) error {
+	if store == nil {
+		return nil
+	}
+	jti, ok := claims["jti"].(string)
+	if !ok {
+		return ErrInvalidToken.Wrap(errors.New("jti not set"))
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return ErrInvalidToken.Wrap(errors.New("issued_at not set or invalid"))
+	}
+	token_ids := []string{jti}
+	// Revoking a session revokes its id rather than every jti minted for it
+	if session_id, ok := claims["sid"].(string); ok {
+		token_ids = append(token_ids, session_id)
+	}
+	for _, token_id := range token_ids {
+		revoked, err := store.IsRevoked(token_id, user_id, issuedAtTime(iat))
+		if err != nil {
+			log.Printf("%s | failed to check revocation: %s\n", txid.String(), err.Error())
+			return errors.New("failed to check revocation")
+		}
+		if revoked {
+			return ErrTokenRevoked
+		}
+	}
+	return nil
+}
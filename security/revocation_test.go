@@ -0,0 +1,62 @@
+package security
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRevokeJWT(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	store := NewMemoryRevocationStore()
+	user_claims := testUserClaims()
+	_, claims := testToken(t, user_claims, config, key_ring)
+	_, other_claims := testToken(t, user_claims, config, key_ring)
+
+	err := RevokeJWT(uuid.New(), claims["jti"].(string), time.Now().Add(time.Hour), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkRevocation(uuid.New(), claims, user_claims.UserID, store)
+	if !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("expected ErrTokenRevoked, got %v", err)
+	}
+	err = checkRevocation(uuid.New(), other_claims, user_claims.UserID, store)
+	if err != nil {
+		t.Fatalf("other token should be valid, got %v", err)
+	}
+}
+
+func TestRevokeUserThenLogInImmediately(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	store := NewMemoryRevocationStore()
+	user_claims := testUserClaims()
+	_, old_claims := testToken(t, user_claims, config, key_ring)
+	// Tokens in the same millisecond as the cutoff are kept
+	time.Sleep(2 * time.Millisecond)
+
+	err := RevokeUserTokens(uuid.New(), user_claims.UserID, time.Now().UTC(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, new_claims := testToken(t, user_claims, config, key_ring)
+
+	err = checkRevocation(uuid.New(), old_claims, user_claims.UserID, store)
+	if !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("token issued before the cutoff should be revoked, got %v", err)
+	}
+	err = checkRevocation(uuid.New(), new_claims, user_claims.UserID, store)
+	if err != nil {
+		t.Fatalf("token issued right after the cutoff should be valid, got %v", err)
+	}
+	other_user_claims := testUserClaims()
+	_, other_claims := testToken(t, other_user_claims, config, key_ring)
+	err = checkRevocation(uuid.New(), other_claims, other_user_claims.UserID, store)
+	if err != nil {
+		t.Fatalf("other users should be unaffected, got %v", err)
+	}
+}
@@ -1,10 +1,12 @@
 package security
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"encoding/base64"
 	"errors"
-	"os"
+	"fmt"
 
 	"log"
 	"strings"
@@ -17,16 +19,57 @@ import (
 	"github.com/google/uuid"
 )
 
-func GenerateJWT(txid uuid.UUID, user_claims types.UserClaims, config types.Config, private_key *rsa.PrivateKey) (string, error) {
-	token := jwt.New(jwt.SigningMethodRS256)
+func GenerateJWT(txid uuid.UUID, user_claims types.UserClaims, config types.Config, key_ring *KeyRing) (string, error) {
+	key_id, method, private_key, err := key_ring.SigningKey()
+	if err != nil {
+		return "", err
+	}
+	if config.App.Host.SigningAlgorithm != "" && config.App.Host.SigningAlgorithm != method.Alg() {
+		return "", fmt.Errorf("signing key %s does not use %s", key_id, config.App.Host.SigningAlgorithm)
+	}
+	expiration_ms := config.App.LoginExpirationMs
+	// Impersonation is time limited regardless of the normal login expiration
+	if user_claims.Actor != nil && config.App.Impersonation.ExpirationMs > 0 && config.App.Impersonation.ExpirationMs < expiration_ms {
+		expiration_ms = config.App.Impersonation.ExpirationMs
+	}
+	token := jwt.New(method)
+	token.Header["kid"] = key_id
 	claims := token.Claims.(jwt.MapClaims)
-	claims["iat"] = time.Now().UTC().Unix()
-	claims["exp"] = time.Now().Add(time.Duration(config.App.LoginExpirationMs) * time.Millisecond).UTC().Unix()
+	claims["iat"] = issuedAt(time.Now().UTC())
+	claims["nbf"] = time.Now().UTC().Unix()
+	claims["exp"] = time.Now().Add(time.Duration(expiration_ms) * time.Millisecond).UTC().Unix()
 	claims["iss"] = config.App.Host.Issuer
+	if len(config.App.Host.IssuedAudience) > 0 {
+		claims["aud"] = config.App.Host.IssuedAudience
+	}
 	claims["jti"] = txid.String()
 	claims["user_id"] = user_claims.UserID.String()
 	claims["issuing_unit"] = user_claims.IssuingUnit
 	claims["role_name"] = user_claims.RoleName
+	if len(user_claims.UnitIDs) > 0 {
+		claims["unit_ids"] = user_claims.UnitIDs
+	}
+	claims["is_instructor"] = user_claims.IsInstructor
+	claims["is_evaluator"] = user_claims.IsEvaluator
+	if len(user_claims.MDSQualifications) > 0 {
+		claims["mds_qualifications"] = user_claims.MDSQualifications
+	}
+	if user_claims.SessionID != uuid.Nil {
+		claims["sid"] = user_claims.SessionID.String()
+	}
+	if len(user_claims.AuthenticationMethods) > 0 {
+		claims["amr"] = user_claims.AuthenticationMethods
+	}
+	if !user_claims.AuthenticatedAt.IsZero() {
+		claims["auth_time"] = user_claims.AuthenticatedAt.UTC().Unix()
+	}
+	if user_claims.Actor != nil {
+		claims["act"] = map[string]interface{}{
+			"sub":         user_claims.Actor.UserID.String(),
+			"role_name":   user_claims.Actor.RoleName,
+			"allow_write": user_claims.Actor.AllowWrite,
+		}
+	}
 	signed_token, err := token.SignedString(private_key)
 	if err != nil {
 		return "", err
@@ -58,97 +101,287 @@ func GetBasicAuth(auth string, config types.Config) (string, string, bool, error
 	return "", "", false, errors.New("invalid header")
 }
 
+// The key loaders accept PEM (PKCS#1, SEC 1, PKCS#8 or PKIX) and JWK files,
+// use LoadPrivateKeyFile for encrypted keys.
 func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
-	bytes, err := os.ReadFile(path)
+	key, err := LoadPrivateKeyFile(path, nil)
 	if err != nil {
 		return nil, err
 	}
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(bytes)
+	rsa_key, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, jwt.ErrNotRSAPrivateKey
+	}
+	return rsa_key, nil
+}
+
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	key, err := LoadPublicKeyFile(path, nil)
 	if err != nil {
 		return nil, err
 	}
-	return key, nil
+	rsa_key, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, jwt.ErrNotRSAPublicKey
+	}
+	return rsa_key, nil
 }
 
-func LoadPublicKey(path string) (*rsa.PublicKey, error) {
-	bytes, err := os.ReadFile(path)
+func LoadECPrivateKey(path string) (*ecdsa.PrivateKey, error) {
+	key, err := LoadPrivateKeyFile(path, nil)
 	if err != nil {
 		return nil, err
 	}
-	key, err := jwt.ParseRSAPublicKeyFromPEM(bytes)
+	ec_key, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, jwt.ErrNotECPrivateKey
+	}
+	return ec_key, nil
+}
+
+func LoadECPublicKey(path string) (*ecdsa.PublicKey, error) {
+	key, err := LoadPublicKeyFile(path, nil)
 	if err != nil {
 		return nil, err
 	}
-	return key, nil
+	ec_key, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, jwt.ErrNotECPublicKey
+	}
+	return ec_key, nil
+}
+
+func LoadEdPrivateKey(path string) (ed25519.PrivateKey, error) {
+	key, err := LoadPrivateKeyFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	ed_key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, jwt.ErrNotEdPrivateKey
+	}
+	return ed_key, nil
+}
+
+func LoadEdPublicKey(path string) (ed25519.PublicKey, error) {
+	key, err := LoadPublicKeyFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	ed_key, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, jwt.ErrNotEdPublicKey
+	}
+	return ed_key, nil
 }
 
 func mapToUserClaims(txid uuid.UUID, claims map[string]interface{}) (types.UserClaims, error) {
 	user_claims := types.UserClaims{}
 
-	user_id, err := uuid.Parse(claims["user_id"].(string))
+	user_id_string, _ := claims["user_id"].(string)
+	user_id, err := uuid.Parse(user_id_string)
 	if err != nil {
 		log.Printf("%s | missing user id\n", txid.String())
-		return user_claims, errors.New("invalid user claims")
+		return user_claims, ErrInvalidToken
 	}
 	user_claims.UserID = user_id
 	issuing_unit, ok := claims["issuing_unit"].(string)
 	if !ok {
 		log.Printf("%s | missing issuing unit\n", txid.String())
-		return user_claims, errors.New("invalid user claims")
+		return user_claims, ErrInvalidToken
 	}
 	user_claims.IssuingUnit = issuing_unit
 	role_name, ok := claims["role_name"].(string)
 	if !ok {
 		log.Printf("%s | missing role name\n", txid.String())
-		return user_claims, errors.New("invalid user claims")
+		return user_claims, ErrInvalidToken
 	}
 	user_claims.RoleName = role_name
+	// Session id is optional, tokens issued outside of a session don't carry one
+	if session_id, ok := claims["sid"].(string); ok {
+		user_claims.SessionID, err = uuid.Parse(session_id)
+		if err != nil {
+			log.Printf("%s | invalid session id\n", txid.String())
+			return user_claims, ErrInvalidToken
+		}
+	}
+	// Tokens issued before these claims existed don't carry them
+	user_claims.UnitIDs, err = stringListClaim(claims, "unit_ids")
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return user_claims, ErrInvalidToken
+	}
+	user_claims.IsInstructor, _ = claims["is_instructor"].(bool)
+	user_claims.IsEvaluator, _ = claims["is_evaluator"].(bool)
+	user_claims.MDSQualifications, err = stringListClaim(claims, "mds_qualifications")
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return user_claims, ErrInvalidToken
+	}
+	user_claims.AuthenticationMethods, err = stringListClaim(claims, "amr")
+	if err != nil {
+		log.Printf("%s | %s\n", txid.String(), err.Error())
+		return user_claims, ErrInvalidToken
+	}
+	if auth_time, ok := claims["auth_time"].(float64); ok {
+		user_claims.AuthenticatedAt = time.Unix(int64(auth_time), 0).UTC()
+	}
+	if actor, ok := claims["act"].(map[string]interface{}); ok {
+		actor_id_string, _ := actor["sub"].(string)
+		actor_id, err := uuid.Parse(actor_id_string)
+		if err != nil {
+			log.Printf("%s | invalid actor\n", txid.String())
+			return user_claims, ErrInvalidToken
+		}
+		actor_role_name, _ := actor["role_name"].(string)
+		allow_write, _ := actor["allow_write"].(bool)
+		user_claims.Actor = &types.ActorClaims{
+			UserID:     actor_id,
+			RoleName:   actor_role_name,
+			AllowWrite: allow_write,
+		}
+	}
 
 	return user_claims, nil
 }
 
-func parseToken(token string, public_key *rsa.PublicKey) (jwt.MapClaims, error) {
-	token = strings.TrimPrefix(token, "Bearer ")
-	parsed_token, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
-		_, ok := t.Method.(*jwt.SigningMethodRSA)
+// stringListClaim reads an optional list of strings, it is nil when missing.
+func stringListClaim(claims map[string]interface{}, name string) ([]string, error) {
+	raw_values, ok := claims[name]
+	if !ok {
+		return nil, nil
+	}
+	values, ok := raw_values.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid %s claim", name)
+	}
+	string_values := make([]string, 0, len(values))
+	for _, value := range values {
+		value_string, ok := value.(string)
 		if !ok {
+			return nil, fmt.Errorf("invalid %s claim", name)
+		}
+		string_values = append(string_values, value_string)
+	}
+	return string_values, nil
+}
+
+func parseToken(token string, key_ring *KeyRing) (jwt.MapClaims, error) {
+	claims, _, err := parseTypedToken(token, key_ring)
+	return claims, err
+}
+
+// parseTypedToken also returns the typ header, which access tokens leave at
+// the library default.
+func parseTypedToken(token string, key_ring *KeyRing) (jwt.MapClaims, string, error) {
+	token = strings.TrimPrefix(token, "Bearer ")
+	// Time based claims are checked in ValidateJWT so clock skew can be allowed for
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	parsed_token, err := parser.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		key_id, _ := t.Header["kid"].(string)
+		method, public_key, err := key_ring.VerificationKey(key_id)
+		if err != nil {
+			return nil, err
+		}
+		// Pin the algorithm to the one configured for the key, never trust the header
+		if t.Method.Alg() != method.Alg() {
 			return nil, errors.New("invalid signing method")
 		}
 		return public_key, nil
 	})
 	if err != nil || !parsed_token.Valid {
 		log.Println(err.Error())
-		return nil, errors.New("invalid jwt")
+		return nil, "", errors.New("invalid jwt")
 	}
 
 	claims, ok := parsed_token.Claims.(jwt.MapClaims)
 	if !ok {
-		return nil, errors.New("missing claims")
+		return nil, "", errors.New("missing claims")
+	}
+	token_type, _ := parsed_token.Header["typ"].(string)
+	return claims, token_type, nil
+}
+
+// verifyAudience passes when the token names at least one of the accepted
+// audiences, hosts that don't configure an audience accept any token.
+func verifyAudience(claims jwt.MapClaims, accepted_audience []string) bool {
+	if len(accepted_audience) == 0 {
+		return true
+	}
+	for _, audience := range accepted_audience {
+		if claims.VerifyAudience(audience, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyClaims checks the registered claims every token must carry.
+func verifyClaims(passed_claims jwt.MapClaims, config types.Config) error {
+	now := time.Now().UTC().Unix()
+	leeway := int64(time.Duration(config.App.Host.ClockSkewMs) * time.Millisecond / time.Second)
+	if !passed_claims.VerifyExpiresAt(now-leeway, true) {
+		return ErrTokenExpired
+	}
+	if !passed_claims.VerifyIssuedAt(now+leeway, true) {
+		return ErrInvalidToken.Wrap(errors.New("issued_at not set or invalid"))
+	}
+	// Tokens issued before nbf was added don't carry one
+	if !passed_claims.VerifyNotBefore(now+leeway, false) {
+		return ErrInvalidToken.Wrap(errors.New("token not valid yet"))
 	}
-	return claims, nil
+	if !passed_claims.VerifyIssuer(config.App.Host.Issuer, true) {
+		return ErrInvalidToken.Wrap(errors.New("issuer not set or invalid"))
+	}
+	if !verifyAudience(passed_claims, config.App.Host.Audience) {
+		return ErrInvalidToken.Wrap(errors.New("audience not set or invalid"))
+	}
+	return nil
 }
 
-func ValidateJWT(txid uuid.UUID, c *fiber.Ctx, config types.Config, public_key *rsa.PublicKey) (types.UserClaims, error) {
+// validateBearer reads the Authorization header, falling back to the session
+// cookie when Config.App.Cookie is enabled.
+func validateBearer(c *fiber.Ctx, config types.Config, key_ring *KeyRing) (jwt.MapClaims, error) {
 	token := c.Get(fiber.HeaderAuthorization)
+	if cookie_token := SessionCookieToken(c, config); cookie_token != "" {
+		token = "Bearer " + cookie_token
+	}
 	if !strings.HasPrefix(token, "Bearer ") {
-		return types.UserClaims{}, errors.New("invalid credentials")
+		return nil, ErrMissingCredentials
 	}
-	passed_claims, err := parseToken(token, public_key)
+	passed_claims, err := parseToken(token, key_ring)
 	if err != nil {
-		return types.UserClaims{}, errors.New("failed to parse current token")
+		return nil, ErrInvalidToken.Wrap(err)
 	}
-	// Make sure the token is valid
-	if !passed_claims.VerifyExpiresAt(time.Now().UTC().Unix(), true) {
-		return types.UserClaims{}, errors.New("token expired or not set")
+	if isActionToken(passed_claims) {
+		return nil, ErrInvalidToken.Wrap(errors.New("action tokens are not access tokens"))
 	}
-	if !passed_claims.VerifyIssuedAt(time.Now().UTC().Unix(), true) {
-		return types.UserClaims{}, errors.New("issued_at not set or invalid")
+	// Make sure the token is valid
+	err = verifyClaims(passed_claims, config)
+	if err != nil {
+		return nil, err
 	}
-	if !passed_claims.VerifyIssuer(config.App.Host.Issuer, true) {
-		return types.UserClaims{}, errors.New("issuer not set or invalid")
+	return passed_claims, nil
+}
+
+func ValidateJWT(txid uuid.UUID, c *fiber.Ctx, config types.Config, key_ring *KeyRing, revocation_store RevocationStore) (types.UserClaims, error) {
+	passed_claims, err := validateBearer(c, config, key_ring)
+	if err != nil {
+		return types.UserClaims{}, err
 	}
+	return validateUserClaims(txid, passed_claims, revocation_store)
+}
 
+func validateUserClaims(txid uuid.UUID, passed_claims jwt.MapClaims, revocation_store RevocationStore) (types.UserClaims, error) {
 	// Make sure the user is valid
 	user_claims, err := mapToUserClaims(txid, passed_claims)
-	return user_claims, err
+	if err != nil {
+		return user_claims, err
+	}
+	// Make sure the token hasn't been revoked
+	err = checkRevocation(txid, passed_claims, user_claims.UserID, revocation_store)
+	if err != nil {
+		return types.UserClaims{}, err
+	}
+	return user_claims, nil
 }
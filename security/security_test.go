@@ -0,0 +1,106 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/thedanisaur/jfl_platform/types"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+func testKeyRing(t *testing.T) *KeyRing {
+	t.Helper()
+	private_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_ring := NewKeyRing()
+	err = key_ring.AddSigningKey("test", "", private_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key_ring
+}
+
+func testConfig() types.Config {
+	config := types.Config{}
+	config.App.Host.Issuer = "https://jfl.test"
+	config.App.LoginExpirationMs = 60000
+	return config
+}
+
+func testUserClaims() types.UserClaims {
+	return types.UserClaims{
+		UserID:      uuid.New(),
+		IssuingUnit: "unit",
+		RoleName:    "role",
+	}
+}
+
+func testToken(t *testing.T, user_claims types.UserClaims, config types.Config, key_ring *KeyRing) (string, jwt.MapClaims) {
+	t.Helper()
+	token, err := GenerateJWT(uuid.New(), user_claims, config, key_ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseToken(token, key_ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, claims
+}
+
+// testRequest runs handler for a single request so it gets a real *fiber.Ctx.
+func testRequest(t *testing.T, request *http.Request, handler fiber.Handler) *http.Response {
+	t.Helper()
+	app := fiber.New()
+	app.All("/*", handler)
+	if request == nil {
+		request = httptest.NewRequest(fiber.MethodGet, "/", nil)
+	}
+	response, err := app.Test(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestIssuedAudienceIsVerifiedByAcceptedAudience(t *testing.T) {
+	key_ring := testKeyRing(t)
+	issuer_config := testConfig()
+	issuer_config.App.Host.Audience = []string{"auth"}
+	issuer_config.App.Host.IssuedAudience = []string{"flight_logs"}
+	_, claims := testToken(t, testUserClaims(), issuer_config, key_ring)
+
+	tests := []struct {
+		name     string
+		audience []string
+		valid    bool
+	}{
+		{"intended service", []string{"flight_logs"}, true},
+		{"one of several accepted", []string{"training", "flight_logs"}, true},
+		{"other service", []string{"training"}, false},
+		{"issuer's own audience", []string{"auth"}, false},
+		{"no restriction", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.App.Host.Audience = test.audience
+			err := verifyClaims(claims, config)
+			if test.valid && err != nil {
+				t.Fatalf("expected valid, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("expected the audience to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package security
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+	"github.com/thedanisaur/jfl_platform/types/SessionLimitPolicy"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+var ErrMaxSessions = types.NewPlatformError(ErrorKind.Conflict, "max_sessions", "maximum number of sessions reached")
+var ErrSessionNotFound = types.NewPlatformError(ErrorKind.NotFound, "session_not_found", "session not found")
+
+type SessionStore interface {
+	Add(session types.SessionDTO) error
+	List(user_id uuid.UUID) ([]types.SessionDTO, error)
+	Remove(user_id uuid.UUID, session_id uuid.UUID) error
+}
+
+type MemorySessionStore struct {
+	mutex    sync.RWMutex
+	sessions map[uuid.UUID]map[uuid.UUID]types.SessionDTO
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: map[uuid.UUID]map[uuid.UUID]types.SessionDTO{},
+	}
+}
+
+func (store *MemorySessionStore) Add(session types.SessionDTO) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	user_sessions, ok := store.sessions[session.UserID]
+	if !ok {
+		user_sessions = map[uuid.UUID]types.SessionDTO{}
+		store.sessions[session.UserID] = user_sessions
+	}
+	user_sessions[session.ID] = session
+	return nil
+}
+
+func (store *MemorySessionStore) List(user_id uuid.UUID) ([]types.SessionDTO, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	sessions := []types.SessionDTO{}
+	for _, session := range store.sessions[user_id] {
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (store *MemorySessionStore) Remove(user_id uuid.UUID, session_id uuid.UUID) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	user_sessions, ok := store.sessions[user_id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if _, ok := user_sessions[session_id]; !ok {
+		return ErrSessionNotFound
+	}
+	delete(user_sessions, session_id)
+	if len(user_sessions) == 0 {
+		delete(store.sessions, user_id)
+	}
+	return nil
+}
+
+// SessionRegistry tracks the sessions issued to each user and enforces
+// Config.App.MaxSessions. Killing a session revokes its id in the revocation
+// store, which ValidateJWT checks against the `sid` claim, and ends its refresh
+// token family when a refresh store is configured.
+type SessionRegistry struct {
+	mutex               sync.Mutex
+	store               SessionStore
+	revocation_store    RevocationStore
+	refresh_token_store RefreshTokenStore
+}
+
+// NewSessionRegistry requires a revocation store, without one an evicted or
+// killed session would keep a valid access token until it expired. The refresh
+// token store is optional.
+func NewSessionRegistry(store SessionStore, revocation_store RevocationStore, refresh_token_store RefreshTokenStore) (*SessionRegistry, error) {
+	if store == nil {
+		return nil, errors.New("missing session store")
+	}
+	if revocation_store == nil {
+		return nil, errors.New("missing revocation store")
+	}
+	return &SessionRegistry{
+		store:               store,
+		revocation_store:    revocation_store,
+		refresh_token_store: refresh_token_store,
+	}, nil
+}
+
+// Register records a new session for the user, assigning user_claims.SessionID
+// when it isn't already set. Call it before GenerateJWT/GenerateTokenPair so a
+// rejected login never gets a token.
+func (registry *SessionRegistry) Register(txid uuid.UUID, c *fiber.Ctx, user_claims *types.UserClaims, config types.Config) error {
+	if user_claims.SessionID == uuid.Nil {
+		user_claims.SessionID = uuid.New()
+	}
+	now := time.Now().UTC()
+	lifetime_ms := config.App.LoginExpirationMs
+	if registry.refresh_token_store != nil && config.App.RefreshExpirationMs > lifetime_ms {
+		lifetime_ms = config.App.RefreshExpirationMs
+	}
+	session := types.SessionDTO{
+		ID:        user_claims.SessionID,
+		UserID:    user_claims.UserID,
+		IPAddress: c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(time.Duration(lifetime_ms) * time.Millisecond),
+	}
+
+	// Serialize registration so concurrent logins can't both squeeze under the limit
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if config.App.MaxSessions > 0 {
+		sessions, err := registry.activeSessions(txid, user_claims.UserID)
+		if err != nil {
+			return err
+		}
+		for len(sessions) >= config.App.MaxSessions {
+			if config.App.SessionLimitPolicy == SessionLimitPolicy.Reject {
+				log.Printf("%s | rejecting session for user %s, %d sessions active\n", txid.String(), user_claims.UserID.String(), len(sessions))
+				return ErrMaxSessions
+			}
+			oldest := sessions[0]
+			log.Printf("%s | evicting session %s for user %s\n", txid.String(), oldest.ID.String(), user_claims.UserID.String())
+			err = registry.revoke(txid, oldest)
+			if err != nil {
+				return err
+			}
+			sessions = sessions[1:]
+		}
+	}
+	return registry.store.Add(session)
+}
+
+// List returns the user's unexpired sessions, oldest first. The session the
+// request was made with is flagged as current.
+func (registry *SessionRegistry) List(txid uuid.UUID, user_claims types.UserClaims) ([]types.SessionDTO, error) {
+	sessions, err := registry.activeSessions(txid, user_claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == user_claims.SessionID
+	}
+	return sessions, nil
+}
+
+// Revoke kills one of the user's sessions, a user can only revoke their own sessions.
+func (registry *SessionRegistry) Revoke(txid uuid.UUID, user_id uuid.UUID, session_id uuid.UUID) error {
+	sessions, err := registry.store.List(user_id)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.ID == session_id {
+			return registry.revoke(txid, session)
+		}
+	}
+	return ErrSessionNotFound
+}
+
+// RevokeAll kills every session the user has, i.e. "log out everywhere".
+func (registry *SessionRegistry) RevokeAll(txid uuid.UUID, user_id uuid.UUID) error {
+	sessions, err := registry.store.List(user_id)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		err = registry.revoke(txid, session)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RotateRefreshToken rotates like security.RotateRefreshToken, a family that
+// is revoked because a token was reused also ends its session.
+func (registry *SessionRegistry) RotateRefreshToken(txid uuid.UUID, token string, config types.Config, key_ring *KeyRing) (types.TokenResponse, error) {
+	if registry.refresh_token_store == nil {
+		return types.TokenResponse{}, errors.New("no refresh token store configured")
+	}
+	return rotateRefreshToken(txid, token, config, key_ring, registry.refresh_token_store, registry.revokeFamily)
+}
+
+// RevokeRefreshToken logs out the session the refresh token belongs to, so it
+// stops counting towards Config.App.MaxSessions.
+func (registry *SessionRegistry) RevokeRefreshToken(txid uuid.UUID, token string) error {
+	if registry.refresh_token_store == nil {
+		return errors.New("no refresh token store configured")
+	}
+	return revokeRefreshToken(txid, token, registry.refresh_token_store, registry.revokeFamily)
+}
+
+// revokeFamily ends the session of a refresh token family, the family id is
+// the session id.
+func (registry *SessionRegistry) revokeFamily(txid uuid.UUID, refresh_token RefreshToken) error {
+	err := registry.revoke(txid, types.SessionDTO{
+		ID:        refresh_token.FamilyID,
+		UserID:    refresh_token.UserClaims.UserID,
+		ExpiresAt: refresh_token.ExpiresAt,
+	})
+	// Sessions issued before the registry was configured aren't tracked
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (registry *SessionRegistry) revoke(txid uuid.UUID, session types.SessionDTO) error {
+	err := RevokeJWT(txid, session.ID.String(), session.ExpiresAt, registry.revocation_store)
+	if err != nil {
+		log.Printf("%s | failed to revoke session: %s\n", txid.String(), err.Error())
+		return errors.New("failed to revoke session")
+	}
+	if registry.refresh_token_store != nil {
+		err := registry.refresh_token_store.RevokeFamily(session.ID)
+		if err != nil {
+			log.Printf("%s | failed to revoke refresh tokens: %s\n", txid.String(), err.Error())
+			return errors.New("failed to revoke session")
+		}
+	}
+	return registry.store.Remove(session.UserID, session.ID)
+}
+
+func (registry *SessionRegistry) activeSessions(txid uuid.UUID, user_id uuid.UUID) ([]types.SessionDTO, error) {
+	sessions, err := registry.store.List(user_id)
+	if err != nil {
+		log.Printf("%s | failed to list sessions: %s\n", txid.String(), err.Error())
+		return nil, errors.New("failed to list sessions")
+	}
+	now := time.Now().UTC()
+	active := []types.SessionDTO{}
+	for _, session := range sessions {
+		if session.ExpiresAt.Before(now) {
+			// Expired sessions don't count towards the limit
+			registry.store.Remove(user_id, session.ID)
+			continue
+		}
+		active = append(active, session)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].IssuedAt.Before(active[j].IssuedAt)
+	})
+	return active, nil
+}
@@ -0,0 +1,108 @@
+package security
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/thedanisaur/jfl_platform/types"
+	"github.com/thedanisaur/jfl_platform/types/SessionLimitPolicy"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func testLogin(t *testing.T, registry *SessionRegistry, user_claims types.UserClaims, config types.Config, key_ring *KeyRing, store RefreshTokenStore) (types.TokenResponse, error) {
+	t.Helper()
+	var response types.TokenResponse
+	var login_err error
+	testRequest(t, nil, func(c *fiber.Ctx) error {
+		login_err = registry.Register(uuid.New(), c, &user_claims, config)
+		if login_err != nil {
+			return nil
+		}
+		response, login_err = GenerateTokenPair(uuid.New(), user_claims, config, key_ring, store)
+		return nil
+	})
+	return response, login_err
+}
+
+func testRegistry(t *testing.T, refresh_token_store RefreshTokenStore) *SessionRegistry {
+	t.Helper()
+	registry, err := NewSessionRegistry(NewMemorySessionStore(), NewMemoryRevocationStore(), refresh_token_store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func TestNewSessionRegistryRequiresRevocation(t *testing.T) {
+	_, err := NewSessionRegistry(NewMemorySessionStore(), nil, nil)
+	if err == nil {
+		t.Fatal("expected a registry without a revocation store to be rejected")
+	}
+	_, err = NewSessionRegistry(nil, NewMemoryRevocationStore(), nil)
+	if err == nil {
+		t.Fatal("expected a registry without a session store to be rejected")
+	}
+}
+
+func TestSessionLogoutFreesSlot(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	config.App.MaxSessions = 1
+	config.App.SessionLimitPolicy = SessionLimitPolicy.Reject
+	config.App.RefreshExpirationMs = 3600000
+	refresh_token_store := NewMemoryRefreshTokenStore()
+	registry := testRegistry(t, refresh_token_store)
+	user_claims := testUserClaims()
+
+	for i := 0; i < 3; i++ {
+		response, err := testLogin(t, registry, user_claims, config, key_ring, refresh_token_store)
+		if err != nil {
+			t.Fatalf("login %d: %v", i, err)
+		}
+		_, err = testLogin(t, registry, user_claims, config, key_ring, refresh_token_store)
+		if !errors.Is(err, ErrMaxSessions) {
+			t.Fatalf("expected ErrMaxSessions while logged in, got %v", err)
+		}
+		err = registry.RevokeRefreshToken(uuid.New(), response.RefreshToken)
+		if err != nil {
+			t.Fatalf("logout %d: %v", i, err)
+		}
+	}
+}
+
+func TestSessionEndsWhenRefreshTokenReused(t *testing.T) {
+	key_ring := testKeyRing(t)
+	config := testConfig()
+	config.App.MaxSessions = 1
+	config.App.SessionLimitPolicy = SessionLimitPolicy.Reject
+	config.App.RefreshExpirationMs = 3600000
+	refresh_token_store := NewMemoryRefreshTokenStore()
+	registry := testRegistry(t, refresh_token_store)
+	user_claims := testUserClaims()
+
+	response, err := testLogin(t, registry, user_claims, config, key_ring, refresh_token_store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = registry.RotateRefreshToken(uuid.New(), response.RefreshToken, config, key_ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = registry.RotateRefreshToken(uuid.New(), response.RefreshToken, config, key_ring)
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	sessions, err := registry.List(uuid.New(), user_claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("expected the session to end, %d left", len(sessions))
+	}
+	_, err = testLogin(t, registry, user_claims, config, key_ring, refresh_token_store)
+	if err != nil {
+		t.Fatalf("login after reuse: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thedanisaur/jfl_platform/types"
+
+	"github.com/google/uuid"
+)
+
+// RFC 6238 parameters, these are what every authenticator app supports
+const totp_period = 30
+const totp_digits = 6
+const totp_secret_length = 20
+const recovery_code_length = 10
+
+var ErrTOTPReplayed = errors.New("totp code already used")
+
+// TOTPReplayStore remembers the last time step accepted for each user so a
+// code can't be used twice, even while it is still inside the drift window.
+type TOTPReplayStore interface {
+	// UseTimeStep records the step and returns false if it, or a later step,
+	// was already used
+	UseTimeStep(user_id uuid.UUID, time_step int64) (bool, error)
+}
+
+type MemoryTOTPReplayStore struct {
+	mutex      sync.Mutex
+	last_steps map[uuid.UUID]int64
+}
+
+func NewMemoryTOTPReplayStore() *MemoryTOTPReplayStore {
+	return &MemoryTOTPReplayStore{
+		last_steps: map[uuid.UUID]int64{},
+	}
+}
+
+func (store *MemoryTOTPReplayStore) UseTimeStep(user_id uuid.UUID, time_step int64) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if last_step, ok := store.last_steps[user_id]; ok && time_step <= last_step {
+		return false, nil
+	}
+	store.last_steps[user_id] = time_step
+	return true, nil
+}
+
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, totp_secret_length)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// TOTPURI builds the otpauth:// URI that authenticator apps read from a QR code.
+func TOTPURI(secret string, account string, config types.Config) string {
+	issuer := config.App.Host.Issuer
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprintf("%d", totp_digits))
+	query.Set("period", fmt.Sprintf("%d", totp_period))
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(account), query.Encode())
+}
+
+func totpCode(key []byte, time_step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(time_step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	// Dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totp_digits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totp_digits, value%modulus)
+}
+
+// VerifyTOTP accepts codes within Config.App.MFA.TOTPSkewSteps steps of the
+// current time to allow for clock drift on the user's device.
+func VerifyTOTP(txid uuid.UUID, user_id uuid.UUID, secret string, code string, config types.Config, store TOTPReplayStore) (bool, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		log.Printf("%s | invalid totp secret\n", txid.String())
+		return false, errors.New("invalid totp secret")
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totp_digits {
+		return false, nil
+	}
+	current_step := time.Now().UTC().Unix() / totp_period
+	skew := int64(config.App.MFA.TOTPSkewSteps)
+	for time_step := current_step - skew; time_step <= current_step+skew; time_step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, time_step)), []byte(code)) != 1 {
+			continue
+		}
+		if store != nil {
+			unused, err := store.UseTimeStep(user_id, time_step)
+			if err != nil {
+				log.Printf("%s | failed to record totp step: %s\n", txid.String(), err.Error())
+				return false, errors.New("failed to verify totp")
+			}
+			if !unused {
+				log.Printf("%s | totp replay for user %s\n", txid.String(), user_id.String())
+				return false, ErrTOTPReplayed
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// GenerateRecoveryCodes returns the codes to show the user once along with
+// the hashes to store. Config.App.MFA.RecoveryCodes sets how many, defaults to 10.
+func GenerateRecoveryCodes(config types.Config) ([]string, []string, error) {
+	count := config.App.MFA.RecoveryCodes
+	if count <= 0 {
+		count = 10
+	}
+	alphabet := "abcdefghjkmnpqrstuvwxyz23456789"
+	codes := make([]string, count)
+	hashes := make([]string, count)
+	for i := range codes {
+		code := make([]byte, recovery_code_length)
+		for j := range code {
+			value, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+			if err != nil {
+				return nil, nil, err
+			}
+			code[j] = alphabet[value.Int64()]
+		}
+		codes[i] = fmt.Sprintf("%s-%s", code[:recovery_code_length/2], code[recovery_code_length/2:])
+		hashes[i] = HashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// MatchRecoveryCode returns the hash that matched so the caller can delete it,
+// recovery codes are single use.
+func MatchRecoveryCode(code string, hashes []string) (string, bool) {
+	code_hash := HashRecoveryCode(code)
+	matched := ""
+	for _, hash := range hashes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(code_hash)) == 1 {
+			matched = hash
+		}
+	}
+	return matched, matched != ""
+}
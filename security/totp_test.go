@@ -0,0 +1,173 @@
+package security
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, truncated to the last six digits
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		code := totpCode(key, test.unix/totp_period)
+		if code != test.code {
+			t.Fatalf("expected %s at %d, got %s", test.code, test.unix, code)
+		}
+	}
+}
+
+// testTOTPStep waits out the last second of a step so the codes computed by
+// the test are for the step VerifyTOTP sees.
+func testTOTPStep() int64 {
+	if time.Now().UTC().Unix()%totp_period == totp_period-1 {
+		time.Sleep(time.Second)
+	}
+	return time.Now().UTC().Unix() / totp_period
+}
+
+func testTOTPKey(t *testing.T, secret string) []byte {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifyTOTPSkewWindow(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testTOTPKey(t, secret)
+	tests := []struct {
+		name       string
+		skew_steps int
+		offset     int64
+		valid      bool
+	}{
+		{"current step", 0, 0, true},
+		{"previous step without skew", 0, -1, false},
+		{"previous step", 1, -1, true},
+		{"next step", 1, 1, true},
+		{"outside the window", 1, -2, false},
+		{"ahead of the window", 1, 2, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.App.MFA.TOTPSkewSteps = test.skew_steps
+			code := totpCode(key, testTOTPStep()+test.offset)
+			valid, err := VerifyTOTP(uuid.New(), uuid.New(), secret, code, config, NewMemoryTOTPReplayStore())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if valid != test.valid {
+				t.Fatalf("expected %v, got %v", test.valid, valid)
+			}
+		})
+	}
+}
+
+func TestVerifyTOTPInput(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	code := totpCode(testTOTPKey(t, secret), testTOTPStep())
+
+	// Authenticator apps show the code in two groups and the secret may be
+	// typed in lowercase
+	valid, err := VerifyTOTP(uuid.New(), uuid.New(), strings.ToLower(secret), code[:3]+" "+code[3:], config, nil)
+	if err != nil || !valid {
+		t.Fatalf("expected a grouped code to verify, got %v %v", valid, err)
+	}
+	valid, err = VerifyTOTP(uuid.New(), uuid.New(), secret, code[:5], config, nil)
+	if err != nil || valid {
+		t.Fatalf("expected a short code to fail, got %v %v", valid, err)
+	}
+	_, err = VerifyTOTP(uuid.New(), uuid.New(), "not base32!", code, config, nil)
+	if err == nil {
+		t.Fatal("expected an invalid secret to fail")
+	}
+}
+
+func TestVerifyTOTPReplay(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testTOTPKey(t, secret)
+	config := testConfig()
+	config.App.MFA.TOTPSkewSteps = 1
+	store := NewMemoryTOTPReplayStore()
+	user_id := uuid.New()
+	current_step := testTOTPStep()
+
+	valid, err := VerifyTOTP(uuid.New(), user_id, secret, totpCode(key, current_step), config, store)
+	if err != nil || !valid {
+		t.Fatalf("expected the code to verify, got %v %v", valid, err)
+	}
+	_, err = VerifyTOTP(uuid.New(), user_id, secret, totpCode(key, current_step), config, store)
+	if !errors.Is(err, ErrTOTPReplayed) {
+		t.Fatalf("expected ErrTOTPReplayed, got %v", err)
+	}
+	// The previous step is still inside the window but older than the one used
+	_, err = VerifyTOTP(uuid.New(), user_id, secret, totpCode(key, current_step-1), config, store)
+	if !errors.Is(err, ErrTOTPReplayed) {
+		t.Fatalf("expected an earlier step to be rejected, got %v", err)
+	}
+	valid, err = VerifyTOTP(uuid.New(), user_id, secret, totpCode(key, current_step+1), config, store)
+	if err != nil || !valid {
+		t.Fatalf("expected a later step to verify, got %v %v", valid, err)
+	}
+
+	// Steps are tracked per user
+	valid, err = VerifyTOTP(uuid.New(), uuid.New(), secret, totpCode(key, current_step), config, store)
+	if err != nil || !valid {
+		t.Fatalf("expected another user to verify, got %v %v", valid, err)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	config := testConfig()
+	config.App.MFA.RecoveryCodes = 4
+	codes, hashes, err := GenerateRecoveryCodes(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 4 || len(hashes) != 4 {
+		t.Fatalf("expected 4 codes, got %d", len(codes))
+	}
+	for i, code := range codes {
+		if strings.Contains(hashes[i], code) {
+			t.Fatal("only the hash of a code may be stored")
+		}
+		// Users retype codes without the dash or in uppercase
+		matched, ok := MatchRecoveryCode(strings.ToUpper(strings.ReplaceAll(code, "-", "")), hashes)
+		if !ok || matched != hashes[i] {
+			t.Fatalf("expected %s to match its own hash", code)
+		}
+	}
+	_, ok := MatchRecoveryCode("aaaaa-aaaaa", hashes)
+	if ok {
+		t.Fatal("an unknown code must not match")
+	}
+}
@@ -0,0 +1,7 @@
+// Values for the `amr` claim, see RFC 8176
+package AuthenticationMethod
+
+const MultiFactor = "mfa"
+const OneTimePassword = "otp"
+const Password = "pwd"
+const SoftwareKey = "swk"
@@ -0,0 +1,11 @@
+package AuthenticationMode
+
+// Required rejects requests without valid credentials
+const Required = "required"
+
+// Optional authenticates requests that send credentials and lets anonymous
+// requests through without user_claims
+const Optional = "optional"
+
+// Public skips authentication entirely
+const Public = "public"
@@ -0,0 +1,9 @@
+package CSRFMode
+
+// DoubleSubmit sets the token in a cookie readable by the page, unsafe
+// requests must echo it in the X-CSRF-Token header
+const DoubleSubmit = "double_submit"
+
+// Synchronizer keeps the token server side, keyed by session, and returns it
+// in the X-CSRF-Token header at login
+const Synchronizer = "synchronizer"
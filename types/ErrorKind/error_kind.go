@@ -0,0 +1,19 @@
+package ErrorKind
+
+// Unauthenticated means the credentials are missing or invalid, 401
+const Unauthenticated = "unauthenticated"
+
+// TokenExpired means the credentials were valid but have expired, 401
+const TokenExpired = "token_expired"
+
+// Forbidden means the caller is authenticated but not allowed, 403
+const Forbidden = "forbidden"
+
+// Validation means the request is malformed or fails a rule, 400
+const Validation = "validation"
+
+// NotFound means the resource doesn't exist, 404
+const NotFound = "not_found"
+
+// Conflict means the request conflicts with the current state, 409
+const Conflict = "conflict"
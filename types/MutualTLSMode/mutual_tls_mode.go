@@ -0,0 +1,13 @@
+package MutualTLSMode
+
+// Disabled only accepts bearer tokens
+const Disabled = ""
+
+// Certificate only accepts client certificates
+const Certificate = "certificate"
+
+// CertificateOrJWT uses the client certificate when one is presented, otherwise the bearer token
+const CertificateOrJWT = "certificate_or_jwt"
+
+// CertificateAndJWT requires both and the certificate must identify the same user as the token
+const CertificateAndJWT = "certificate_and_jwt"
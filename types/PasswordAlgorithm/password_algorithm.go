@@ -0,0 +1,4 @@
+package PasswordAlgorithm
+
+const Argon2id = "argon2id"
+const Bcrypt = "bcrypt"
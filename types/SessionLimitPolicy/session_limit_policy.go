@@ -0,0 +1,4 @@
+package SessionLimitPolicy
+
+const EvictOldest = "evict_oldest"
+const Reject = "reject"
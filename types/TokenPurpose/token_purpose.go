@@ -0,0 +1,4 @@
+package TokenPurpose
+
+const PasswordReset = "password_reset"
+const EmailVerification = "email_verification"
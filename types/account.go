@@ -0,0 +1,35 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type PasswordResetRequest struct {
+	Username string `json:"username"`
+}
+
+type PasswordResetConfirmation struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type EmailVerificationConfirmation struct {
+	Token string `json:"token"`
+}
+
+// ActionTokenClaims are the claims of a password reset or email verification
+// token. BindingHash ties the token to state that changes once it is used,
+// i.e. the password hash or the email address.
+type ActionTokenClaims struct {
+	TokenID     string
+	UserID      uuid.UUID
+	Purpose     string
+	BindingHash string
+	ExpiresAt   time.Time
+}
+
+type ReauthenticationRequest struct {
+	Password string `json:"password"`
+}
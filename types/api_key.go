@@ -0,0 +1,20 @@
+package types
+
+import (
+	"time"
+)
+
+// APIKey is the stored half of an integration key, only the hash of the key
+// is kept. UserClaims is the identity policies see for requests made with it.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	KeyHash    string     `json:"-"`
+	UserClaims UserClaims `json:"user_claims"`
+	Scopes     []string   `json:"scopes"`
+	Resources  []string   `json:"resources,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedOn  time.Time  `json:"created_on"`
+	Revoked    bool       `json:"revoked"`
+}
@@ -0,0 +1,21 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type AuditEvent struct {
+	TransactionID uuid.UUID  `json:"transaction_id"`
+	Action        string     `json:"action"`
+	UserID        uuid.UUID  `json:"user_id"`
+	ActorID       *uuid.UUID `json:"actor_id,omitempty"`
+	Method        string     `json:"method,omitempty"`
+	Path          string     `json:"path,omitempty"`
+	Resource      string     `json:"resource,omitempty"`
+	Operation     string     `json:"operation,omitempty"`
+	Allowed       bool       `json:"allowed"`
+	Detail        string     `json:"detail,omitempty"`
+	OccurredOn    time.Time  `json:"occurred_on"`
+}
@@ -0,0 +1,16 @@
+package types
+
+// ClientClaims identify a machine client, i.e. a background job calling
+// another service, as opposed to UserClaims which identify a person.
+type ClientClaims struct {
+	ClientID string   `json:"client_id"`
+	Scopes   []string `json:"scope"`
+}
+
+type ServiceClient struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	SecretHash string   `json:"-"`
+	Scopes     []string `json:"scopes"`
+	Disabled   bool     `json:"disabled"`
+}
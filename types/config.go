@@ -11,26 +11,112 @@ type Config struct {
 		}
 	}
 	App struct {
-		LoginExpirationMs int `json:"login_expiration_ms"`
-		MaxSessions       int `json:"max_sessions"`
+		ClientExpirationMs  int    `json:"client_expiration_ms"`
+		LoginExpirationMs   int    `json:"login_expiration_ms"`
+		MaxSessions         int    `json:"max_sessions"`
+		RefreshExpirationMs int    `json:"refresh_expiration_ms"`
+		SessionLimitPolicy  string `json:"session_limit_policy"`
 
 		Host struct {
-			CertificatePath string `json:"cert_path"`
-			Issuer          string `json:"issuer"`
-			KeyPath         string `json:"key_path"`
-			Port            int    `json:"port"`
-			UseTLS          bool   `json:"use_tls"`
+			// Audience is the list of audiences accepted by this host, a token
+			// must name at least one of them.
+			Audience        []string `json:"audience"`
+			CertificatePath string   `json:"cert_path"`
+			ClockSkewMs     int      `json:"clock_skew_ms"`
+			// IssuedAudience is emitted in tokens issued by this host, keep it
+			// to the services the tokens are meant for. Tokens carry no
+			// audience when it's empty.
+			IssuedAudience   []string `json:"issued_audience"`
+			Issuer           string   `json:"issuer"`
+			KeyPath          string   `json:"key_path"`
+			Port             int      `json:"port"`
+			SigningAlgorithm string   `json:"signing_algorithm"`
+			UseTLS           bool     `json:"use_tls"`
+		}
+		// ActionTokens are the single use tokens sent by email, they can't be
+		// used as access tokens
+		ActionTokens struct {
+			EmailVerificationExpirationMs int `json:"email_verification_expiration_ms"`
+			PasswordResetExpirationMs     int `json:"password_reset_expiration_ms"`
+		}
+		// Cookie sets the access token in an HttpOnly cookie at login for
+		// browser clients, bearer tokens are still accepted
+		Cookie struct {
+			CSRFCookieName string `json:"csrf_cookie_name"`
+			CSRFMode       string `json:"csrf_mode"`
+			Domain         string `json:"domain"`
+			Enabled        bool   `json:"enabled"`
+			Name           string `json:"name"`
+			Path           string `json:"path"`
+			// RefreshCookieName and RefreshPath name and scope the refresh
+			// token cookie, set RefreshPath to the refresh endpoint so no other
+			// request carries the token
+			RefreshCookieName string `json:"refresh_cookie_name"`
+			RefreshPath       string `json:"refresh_path"`
+			SameSite          string `json:"same_site"`
 		}
 		Cors struct {
 			AllowCredentials bool     `json:"allow_credentials"`
 			AllowHeaders     []string `json:"allow_headers"`
 			AllowOrigins     []string `json:"allow_origins"`
 		}
+		Impersonation struct {
+			AllowedRoles []string `json:"allowed_roles"`
+			ExpirationMs int      `json:"expiration_ms"`
+		}
+		// Keys is the signing and verification key directory, see
+		// security.LoadKeyRing. The passphrase for encrypted keys is read from
+		// the PassphraseEnv variable or PassphraseFile.
+		Keys struct {
+			Directory        string `json:"directory"`
+			PassphraseEnv    string `json:"passphrase_env"`
+			PassphraseFile   string `json:"passphrase_file"`
+			ReloadIntervalMs int    `json:"reload_interval_ms"`
+			SigningKeyID     string `json:"signing_key_id"`
+		}
 		Limiter struct {
 			Expiration               int  `json:"expiration"`
 			LimiterSlidingMiddleware bool `json:"limiter_sliding_middleware"`
 			Max                      int  `json:"max_requests"`
 			SkipSuccessfulRequests   bool `json:"skip_successful_requests"`
 		}
+		Lockout struct {
+			DurationMs  int `json:"duration_ms"`
+			MaxAttempts int `json:"max_attempts"`
+			// Failures older than this are forgotten, defaults to 15 minutes
+			FailureWindowMs int `json:"failure_window_ms"`
+		}
+		MFA struct {
+			RecoveryCodes int `json:"recovery_codes"`
+			TOTPSkewSteps int `json:"totp_skew_steps"`
+		}
+		MutualTLS struct {
+			ClientCAPath string `json:"client_ca_path"`
+			// Mapping maps a user claim (user_id, issuing_unit, role_name) to
+			// a certificate field (subject_cn, subject_ou, subject_o,
+			// subject_serial, san_email, san_dns, san_uri) or to a fixed
+			// value with the literal: prefix
+			Mapping map[string]string `json:"mapping"`
+			Mode    string            `json:"mode"`
+		}
+		Password struct {
+			Algorithm string `json:"algorithm"`
+			Argon2id  struct {
+				MemoryKiB   uint32 `json:"memory_kib"`
+				Iterations  uint32 `json:"iterations"`
+				Parallelism uint8  `json:"parallelism"`
+				SaltLength  uint32 `json:"salt_length"`
+				KeyLength   uint32 `json:"key_length"`
+			}
+			BcryptCost int `json:"bcrypt_cost"`
+			Policy     struct {
+				MaxLength        int  `json:"max_length"`
+				MinLength        int  `json:"min_length"`
+				RequireDigit     bool `json:"require_digit"`
+				RequireLowercase bool `json:"require_lowercase"`
+				RequireSymbol    bool `json:"require_symbol"`
+				RequireUppercase bool `json:"require_uppercase"`
+			}
+		}
 	}
 }
@@ -0,0 +1,96 @@
+package types
+
+import (
+	"net/http"
+
+	"github.com/thedanisaur/jfl_platform/types/ErrorKind"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// PlatformError is returned by the platform packages for failures a client
+// should see. Kind decides the HTTP status, Code is a stable machine code
+// clients can rely on and Message is safe to show. The cause is only for logs.
+// handler.ErrorHandler adds the code, fields and 401 challenges to the
+// response, fiber's default error handler only sees the status and message.
+type PlatformError struct {
+	Kind    string
+	Code    string
+	Message string
+	Fields  []FieldError
+	cause   error
+}
+
+// FieldError describes why a single request field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func NewPlatformError(kind string, code string, message string) *PlatformError {
+	return &PlatformError{
+		Kind:    kind,
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (platform_error *PlatformError) Error() string {
+	if platform_error.cause != nil {
+		return platform_error.Message + ": " + platform_error.cause.Error()
+	}
+	return platform_error.Message
+}
+
+func (platform_error *PlatformError) Unwrap() error {
+	return platform_error.cause
+}
+
+// StatusCode is the HTTP status for Kind, unknown kinds are server errors.
+func (platform_error *PlatformError) StatusCode() int {
+	switch platform_error.Kind {
+	case ErrorKind.Unauthenticated, ErrorKind.TokenExpired:
+		return http.StatusUnauthorized
+	case ErrorKind.Forbidden:
+		return http.StatusForbidden
+	case ErrorKind.Validation:
+		return http.StatusBadRequest
+	case ErrorKind.NotFound:
+		return http.StatusNotFound
+	case ErrorKind.Conflict:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// As converts to a *fiber.Error so fiber's default error handler, and anything
+// else that looks for one, answers with the right status.
+func (platform_error *PlatformError) As(target interface{}) bool {
+	fiber_error, ok := target.(**fiber.Error)
+	if !ok {
+		return false
+	}
+	*fiber_error = fiber.NewError(platform_error.StatusCode(), platform_error.Message)
+	return true
+}
+
+// Is matches on Code, so errors.Is works against the package sentinels even
+// after Wrap or WithFields made a copy.
+func (platform_error *PlatformError) Is(target error) bool {
+	target_error, ok := target.(*PlatformError)
+	return ok && target_error.Code == platform_error.Code
+}
+
+// Wrap returns a copy carrying the underlying cause.
+func (platform_error *PlatformError) Wrap(cause error) *PlatformError {
+	wrapped := *platform_error
+	wrapped.cause = cause
+	return &wrapped
+}
+
+// WithFields returns a copy carrying per field validation errors.
+func (platform_error *PlatformError) WithFields(fields ...FieldError) *PlatformError {
+	with_fields := *platform_error
+	with_fields.Fields = append(append([]FieldError{}, platform_error.Fields...), fields...)
+	return &with_fields
+}
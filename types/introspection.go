@@ -0,0 +1,17 @@
+package types
+
+// IntrospectionResponse follows RFC 7662, inactive tokens only report `active`.
+type IntrospectionResponse struct {
+	Active     bool        `json:"active"`
+	Scope      string      `json:"scope,omitempty"`
+	ClientID   string      `json:"client_id,omitempty"`
+	TokenType  string      `json:"token_type,omitempty"`
+	ExpiresAt  int64       `json:"exp,omitempty"`
+	IssuedAt   int64       `json:"iat,omitempty"`
+	NotBefore  int64       `json:"nbf,omitempty"`
+	Subject    string      `json:"sub,omitempty"`
+	Audience   []string    `json:"aud,omitempty"`
+	Issuer     string      `json:"iss,omitempty"`
+	TokenID    string      `json:"jti,omitempty"`
+	UserClaims *UserClaims `json:"user_claims,omitempty"`
+}
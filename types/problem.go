@@ -0,0 +1,13 @@
+package types
+
+// ProblemDetails follows RFC 7807, Code and Errors are extension members.
+// Instance is the transaction id so a report can be matched to the logs.
+type ProblemDetails struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
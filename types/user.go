@@ -7,9 +7,54 @@ import (
 )
 
 type UserClaims struct {
-	UserID      uuid.UUID `json:"user_id"`
-	IssuingUnit string    `json:"issuing_unit"`
-	RoleName    string    `json:"role_name"`
+	UserID                uuid.UUID `json:"user_id"`
+	IssuingUnit           string    `json:"issuing_unit"`
+	RoleName              string    `json:"role_name"`
+	SessionID             uuid.UUID `json:"session_id"`
+	AuthenticationMethods []string  `json:"amr,omitempty"`
+	// AuthenticatedAt is when the user last proved who they are, refreshing a
+	// token keeps it and re-authenticating moves it forward
+	AuthenticatedAt time.Time `json:"auth_time"`
+	// UnitIDs lists every unit the user belongs to, IssuingUnit included
+	UnitIDs           []string `json:"unit_ids,omitempty"`
+	IsInstructor      bool     `json:"is_instructor"`
+	IsEvaluator       bool     `json:"is_evaluator"`
+	MDSQualifications []string `json:"mds_qualifications,omitempty"`
+	// Actor is set when an administrator is impersonating the user
+	Actor *ActorClaims `json:"act,omitempty"`
+	// APIKeyID, Scopes and Resources are set for requests made with an API key
+	APIKeyID  string   `json:"api_key_id,omitempty"`
+	Scopes    []string `json:"scope,omitempty"`
+	Resources []string `json:"resources,omitempty"`
+}
+
+// UserAttributes are the claims a ClaimsProvider refreshes from the database
+// on every request, they replace what the token was issued with.
+type UserAttributes struct {
+	IssuingUnit       string
+	RoleName          string
+	UnitIDs           []string
+	IsInstructor      bool
+	IsEvaluator       bool
+	MDSQualifications []string
+}
+
+// Apply overwrites the attributes of the claims, identity, session and
+// impersonation claims are kept.
+func (user_attributes UserAttributes) Apply(user_claims UserClaims) UserClaims {
+	user_claims.IssuingUnit = user_attributes.IssuingUnit
+	user_claims.RoleName = user_attributes.RoleName
+	user_claims.UnitIDs = user_attributes.UnitIDs
+	user_claims.IsInstructor = user_attributes.IsInstructor
+	user_claims.IsEvaluator = user_attributes.IsEvaluator
+	user_claims.MDSQualifications = user_attributes.MDSQualifications
+	return user_claims
+}
+
+type ActorClaims struct {
+	UserID     uuid.UUID `json:"user_id"`
+	RoleName   string    `json:"role_name"`
+	AllowWrite bool      `json:"allow_write"`
 }
 
 type UserClaimsAccessor func(user_claims *UserClaims) interface{}
@@ -18,6 +63,91 @@ var UserClaimsAccessors = map[string]UserClaimsAccessor{
 	"user_id":      func(user_claims *UserClaims) interface{} { return user_claims.UserID },
 	"issuing_unit": func(user_claims *UserClaims) interface{} { return user_claims.IssuingUnit },
 	"role_name":    func(user_claims *UserClaims) interface{} { return user_claims.RoleName },
+	"unit_ids": func(user_claims *UserClaims) interface{} {
+		return stringsToInterfaces(user_claims.UnitIDs)
+	},
+	"is_instructor": func(user_claims *UserClaims) interface{} { return user_claims.IsInstructor },
+	"is_evaluator":  func(user_claims *UserClaims) interface{} { return user_claims.IsEvaluator },
+	"mds_qualifications": func(user_claims *UserClaims) interface{} {
+		return stringsToInterfaces(user_claims.MDSQualifications)
+	},
+	"amr": func(user_claims *UserClaims) interface{} {
+		return stringsToInterfaces(user_claims.AuthenticationMethods)
+	},
+	"auth_time": func(user_claims *UserClaims) interface{} {
+		if user_claims.AuthenticatedAt.IsZero() {
+			return int64(0)
+		}
+		return user_claims.AuthenticatedAt.Unix()
+	},
+	"is_impersonated": func(user_claims *UserClaims) interface{} { return user_claims.Actor != nil },
+	"actor_id": func(user_claims *UserClaims) interface{} {
+		if user_claims.Actor == nil {
+			return nil
+		}
+		return user_claims.Actor.UserID
+	},
+	"actor_allow_write": func(user_claims *UserClaims) interface{} {
+		return user_claims.Actor != nil && user_claims.Actor.AllowWrite
+	},
+	"api_key_id": func(user_claims *UserClaims) interface{} { return user_claims.APIKeyID },
+	"scopes":     func(user_claims *UserClaims) interface{} { return stringsToInterfaces(user_claims.Scopes) },
+	"resources":  func(user_claims *UserClaims) interface{} { return stringsToInterfaces(user_claims.Resources) },
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	interfaces := make([]interface{}, len(values))
+	for i, value := range values {
+		interfaces[i] = value
+	}
+	return interfaces
+}
+
+// UserClaimsMap exposes every accessor as a map, i.e. the request_user
+// variable for EvaluateWrite. UUIDs are converted to strings for CEL.
+func UserClaimsMap(user_claims UserClaims) map[string]interface{} {
+	request_user := map[string]interface{}{}
+	for name, accessor := range UserClaimsAccessors {
+		value := accessor(&user_claims)
+		if id, ok := value.(uuid.UUID); ok {
+			value = id.String()
+		}
+		request_user[name] = value
+	}
+	return request_user
+}
+
+// NewUserClaims builds the claims of a token for the user. Unit memberships
+// are the issuing unit and unit charged, services with more memberships can
+// add them with a ClaimsProvider.
+func NewUserClaims(user UserResponse) UserClaims {
+	user_claims := UserClaims{
+		UserID:       user.ID,
+		IssuingUnit:  user.IssuingUnit,
+		RoleName:     user.Role,
+		IsInstructor: user.IsInstructor,
+		IsEvaluator:  user.IsEvaluator,
+	}
+	for _, unit := range []string{user.IssuingUnit, user.UnitCharged} {
+		if unit != "" && !containsString(user_claims.UnitIDs, unit) {
+			user_claims.UnitIDs = append(user_claims.UnitIDs, unit)
+		}
+	}
+	for _, mds := range []string{user.PrimaryMDS, user.SecondaryMDS} {
+		if mds != "" && !containsString(user_claims.MDSQualifications, mds) {
+			user_claims.MDSQualifications = append(user_claims.MDSQualifications, mds)
+		}
+	}
+	return user_claims
+}
+
+func containsString(values []string, value string) bool {
+	for _, existing := range values {
+		if existing == value {
+			return true
+		}
+	}
+	return false
 }
 
 type UserRequest struct {